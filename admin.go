@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rossmackay/rockhoppers-db/models"
+	"github.com/rossmackay/rockhoppers-db/syncer"
+)
+
+// validateAdminKey guards the admin routes. It accepts any API key with the
+// admin scope, and the ADMIN_API_KEY shared secret if one is set.
+func validateAdminKey(auth *keyAuth, adminKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey := apiKeyFromRequest(c)
+		if apiKey == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key is required"})
+			return
+		}
+
+		if adminKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(adminKey)) == 1 {
+			c.Next()
+			return
+		}
+
+		key, ok := authenticateAPIKey(c, auth, apiKey)
+		if !ok {
+			return
+		}
+
+		if !key.HasScope(models.ScopeAdmin) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+
+		c.Set("member_id", key.MemberID)
+		c.Set("api_key", key)
+		c.Next()
+	}
+}
+
+// registerSyncAdminRoutes adds routes to trigger and follow in-process syncs.
+// Runs started here are tied to ctx rather than the request, so they carry on
+// after the response is sent.
+func registerSyncAdminRoutes(admin *gin.RouterGroup, ctx context.Context, s *syncer.Syncer) {
+	startSync := func(c *gin.Context, tables ...string) {
+		run, err := s.Start(ctx, syncer.TriggerAdmin, tables...)
+		if errors.Is(err, syncer.ErrSyncInProgress) {
+			status := s.Status()
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "run": status.Current})
+			return
+		}
+		if errors.Is(err, syncer.ErrUnknownTable) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Location", "/admin/sync/runs/"+run.ID)
+		c.JSON(http.StatusAccepted, run)
+	}
+
+	admin.POST("/sync", func(c *gin.Context) {
+		startSync(c)
+	})
+
+	admin.POST("/sync/:table", func(c *gin.Context) {
+		startSync(c, c.Param("table"))
+	})
+
+	admin.GET("/sync", func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.Status())
+	})
+
+	admin.GET("/sync/runs/:id", func(c *gin.Context) {
+		run, err := s.GetRun(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Sync run not found"})
+			return
+		}
+		c.JSON(http.StatusOK, run)
+	})
+}
+
+// registerKeyAdminRoutes adds routes to issue, rotate and revoke API keys. The
+// secret is only ever returned in the response that creates a key.
+func registerKeyAdminRoutes(admin *gin.RouterGroup, store *models.Database, auth *keyAuth) {
+	keyError := func(c *gin.Context, err error) {
+		switch {
+		case errors.Is(err, models.ErrAPIKeyNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		case errors.Is(err, models.ErrAPIKeyRevoked):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, models.ErrMemberNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		case errors.Is(err, models.ErrInvalidQuery):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+	}
+
+	keyID := func(c *gin.Context) (int64, bool) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return 0, false
+		}
+		return id, true
+	}
+
+	issued := func(c *gin.Context, key *models.APIKey, secret string) {
+		c.Header("Location", "/admin/keys/"+strconv.FormatInt(key.ID, 10))
+		c.JSON(http.StatusCreated, gin.H{"key": key, "secret": secret})
+	}
+
+	admin.GET("/keys", func(c *gin.Context) {
+		var memberID int64
+		if v := c.Query("member_id"); v != "" {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "member_id must be a number"})
+				return
+			}
+			memberID = id
+		}
+
+		keys, err := models.ListAPIKeys(auth.db, memberID)
+		if err != nil {
+			keyError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"keys": keys})
+	})
+
+	admin.POST("/keys", func(c *gin.Context) {
+		var req models.APIKeyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		exists, err := models.MemberExists(store.DB(), strconv.FormatInt(req.MemberID, 10))
+		if err != nil {
+			keyError(c, err)
+			return
+		}
+		if !exists {
+			keyError(c, models.ErrMemberNotFound)
+			return
+		}
+
+		key, secret, err := models.IssueAPIKey(auth.db, req)
+		if err != nil {
+			keyError(c, err)
+			return
+		}
+		issued(c, key, secret)
+	})
+
+	admin.GET("/keys/:id", func(c *gin.Context) {
+		id, ok := keyID(c)
+		if !ok {
+			return
+		}
+
+		key, err := models.GetAPIKey(auth.db, id)
+		if err != nil {
+			keyError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, key)
+	})
+
+	admin.POST("/keys/:id/rotate", func(c *gin.Context) {
+		id, ok := keyID(c)
+		if !ok {
+			return
+		}
+
+		key, secret, err := models.RotateAPIKey(auth.db, id)
+		if err != nil {
+			keyError(c, err)
+			return
+		}
+		auth.forget()
+		issued(c, key, secret)
+	})
+
+	admin.DELETE("/keys/:id", func(c *gin.Context) {
+		id, ok := keyID(c)
+		if !ok {
+			return
+		}
+
+		key, err := models.RevokeAPIKey(auth.db, id)
+		if err != nil {
+			keyError(c, err)
+			return
+		}
+		auth.forget()
+		c.JSON(http.StatusOK, key)
+	})
+
+	admin.GET("/keys/:id/usage", func(c *gin.Context) {
+		id, ok := keyID(c)
+		if !ok {
+			return
+		}
+
+		days := 30
+		if v := c.Query("days"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 366 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 366"})
+				return
+			}
+			days = n
+		}
+
+		if _, err := models.GetAPIKey(auth.db, id); err != nil {
+			keyError(c, err)
+			return
+		}
+
+		// Include requests not yet written back
+		auth.usage.flush()
+
+		usage, err := models.GetAPIKeyUsage(auth.db, id, days)
+		if err != nil {
+			keyError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"usage": usage})
+	})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rossmackay/rockhoppers-db/models"
+)
+
+// maxCachedFeeds bounds the calendar cache, which grows with every member
+// feed and query variant requested between syncs
+const maxCachedFeeds = 1000
+
+// syncVersion identifies the data currently being served. It changes when a
+// new snapshot is swapped in or a table is synced.
+type syncVersion struct {
+	key          string
+	lastModified time.Time
+}
+
+func currentSyncVersion(store *models.Database) (syncVersion, error) {
+	lastSync, err := models.GetLastSyncTime(store.DB())
+	if err != nil {
+		return syncVersion{}, err
+	}
+
+	return syncVersion{
+		key:          fmt.Sprintf("%d-%d", store.Generation(), lastSync.UnixNano()),
+		lastModified: lastSync,
+	}, nil
+}
+
+func (v syncVersion) etag(variant string) string {
+	sum := sha1.Sum([]byte(v.key + "|" + variant))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// setValidators sets the headers clients revalidate a response with
+func setValidators(h http.Header, etag string, lastModified time.Time) {
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "no-cache")
+	if !lastModified.IsZero() {
+		h.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified reports whether the client's conditional headers show it
+// already has this version
+func notModified(c *gin.Context, etag string, lastModified time.Time) bool {
+	// If-None-Match takes precedence over If-Modified-Since
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := c.GetHeader("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil && !lastModified.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sendNotModified sends a 304 with the validators and reports true if the
+// client's conditional headers show it already has this version. Otherwise
+// nothing is written, and the validators are left to go on the response once
+// it succeeds.
+func sendNotModified(c *gin.Context, etag string, lastModified time.Time) bool {
+	if !notModified(c, etag, lastModified) {
+		return false
+	}
+	setValidators(c.Writer.Header(), etag, lastModified)
+	c.AbortWithStatus(http.StatusNotModified)
+	return true
+}
+
+// validatorWriter adds the validators to a response once it turns out to be
+// a success, so errors aren't cached against the version's ETag
+type validatorWriter struct {
+	gin.ResponseWriter
+	etag         string
+	lastModified time.Time
+}
+
+func (w *validatorWriter) setIfSuccess(code int) {
+	if !w.Written() && code >= 200 && code < 300 {
+		setValidators(w.Header(), w.etag, w.lastModified)
+	}
+}
+
+func (w *validatorWriter) WriteHeader(code int) {
+	w.setIfSuccess(code)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *validatorWriter) Write(data []byte) (int, error) {
+	w.setIfSuccess(w.Status())
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *validatorWriter) WriteString(s string) (int, error) {
+	w.setIfSuccess(w.Status())
+	return w.ResponseWriter.WriteString(s)
+}
+
+// conditionalGet answers repeat requests for JSON endpoints with a 304 when
+// nothing has been synced since the client last fetched them
+func conditionalGet(store *models.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		version, err := currentSyncVersion(store)
+		if err != nil {
+			// Serve uncached rather than fail the request
+			c.Next()
+			return
+		}
+
+		etag := version.etag(c.Request.URL.RequestURI())
+		if sendNotModified(c, etag, version.lastModified) {
+			return
+		}
+
+		c.Writer = &validatorWriter{ResponseWriter: c.Writer, etag: etag, lastModified: version.lastModified}
+		c.Next()
+	}
+}
+
+type cachedFeed struct {
+	body string
+	etag string
+}
+
+// feedCache holds serialised calendars per feed variant until the sync
+// version changes
+type feedCache struct {
+	mu      sync.Mutex
+	version string
+	entries map[string]cachedFeed
+}
+
+func newFeedCache() *feedCache {
+	return &feedCache{entries: make(map[string]cachedFeed)}
+}
+
+func (fc *feedCache) get(version syncVersion, variant string) (cachedFeed, bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.version != version.key {
+		fc.version = version.key
+		fc.entries = make(map[string]cachedFeed)
+		return cachedFeed{}, false
+	}
+
+	feed, ok := fc.entries[variant]
+	return feed, ok
+}
+
+func (fc *feedCache) put(version syncVersion, variant string, feed cachedFeed) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.version != version.key {
+		return
+	}
+	if len(fc.entries) >= maxCachedFeeds {
+		fc.entries = make(map[string]cachedFeed)
+	}
+	fc.entries[variant] = feed
+}
+
+// serveCalendar writes a calendar for the options, from cache when possible
+func serveCalendar(c *gin.Context, store *models.Database, cache *feedCache, opts models.CalendarOptions) {
+	// Default windows are relative to today, so the day is part of the
+	// variant, and event notes change once the data goes stale
+	opts.LoadSyncTimes(store.DB())
+	now := time.Now()
+	variant := strings.Join([]string{
+		c.Request.URL.Path,
+		c.Request.URL.Query().Encode(),
+		opts.MemberID,
+		fmt.Sprintf("reminders=%t,%t", opts.BookingReminderEvents, opts.BookingReminderAlarms),
+		now.Format("2006-01-02"),
+		fmt.Sprintf("stale=%t,%t", opts.MeetsSynced.Stale, opts.SocialsSynced.Stale),
+	}, "|")
+
+	version, versionErr := currentSyncVersion(store)
+	version.lastModified = feedLastModified(version.lastModified, opts, now)
+	if versionErr == nil {
+		if feed, ok := cache.get(version, variant); ok {
+			if sendNotModified(c, feed.etag, version.lastModified) {
+				return
+			}
+			setValidators(c.Writer.Header(), feed.etag, version.lastModified)
+			writeCalendar(c, feed.body)
+			return
+		}
+	}
+
+	icsData, err := models.GenerateCalendar(store.DB(), opts)
+	if errors.Is(err, models.ErrMemberNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if versionErr == nil {
+		feed := cachedFeed{body: icsData, etag: version.etag(variant)}
+		cache.put(version, variant, feed)
+		if sendNotModified(c, feed.etag, version.lastModified) {
+			return
+		}
+		setValidators(c.Writer.Header(), feed.etag, version.lastModified)
+	}
+
+	writeCalendar(c, icsData)
+}
+
+// feedLastModified is when a feed last changed. That's the sync unless the
+// day has turned or the data has gone stale since, either of which changes the
+// feed without a sync, and If-Modified-Since would otherwise keep serving the
+// old one.
+func feedLastModified(synced time.Time, opts models.CalendarOptions, now time.Time) time.Time {
+	lastModified := synced
+
+	year, month, day := now.Date()
+	if today := time.Date(year, month, day, 0, 0, 0, 0, now.Location()); today.After(lastModified) {
+		lastModified = today
+	}
+
+	for _, table := range []*models.TableSyncTime{opts.MeetsSynced, opts.SocialsSynced} {
+		if table == nil || !table.Known || !table.Stale {
+			continue
+		}
+		if staleSince := table.LastSuccess.Add(models.SyncStaleAfter); staleSince.After(lastModified) {
+			lastModified = staleSince
+		}
+	}
+
+	return lastModified
+}
+
+func writeCalendar(c *gin.Context, icsData string) {
+	c.Header("Content-Type", "text/calendar; charset=utf-8")
+	c.Header("Content-Disposition", "attachment; filename=rockhoppers-meets.ics")
+	c.String(http.StatusOK, icsData)
+}
@@ -0,0 +1,269 @@
+// Command keys manages the API keys in the keys database the API uses.
+//
+//	keys [-db path] [-data-db path] [-format table|json] <command> [flags]
+//
+// Commands are list, show, issue, rotate, revoke, export and import. Secrets
+// are only printed when a key is issued or rotated.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rossmackay/rockhoppers-db/models"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: keys [flags] <command> [command flags]
+
+Commands:
+  list                          list every key
+  show -member ID               list a member's keys
+  issue -member ID [-scopes s] [-label l] [-expires-in d]
+                                issue a key and print its secret
+  rotate -id ID                 revoke a key and issue a replacement
+  revoke -id ID                 revoke a key
+  export                        write every key, including hashes, and the
+                                calendar tokens and preferences as JSON
+  import FILE                   load an export, replacing matching entries
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+
+	dataPath := flag.String("data-db", os.Getenv("DB_PATH"), "path to the synced SQLite database, used to check members exist")
+	keysPath := os.Getenv("KEYS_DB_PATH")
+	if keysPath == "" && os.Getenv("DB_PATH") != "" {
+		keysPath = models.DefaultKeysPath(os.Getenv("DB_PATH"))
+	}
+	dbPath := flag.String("db", keysPath, "path to the keys database")
+	format := flag.String("format", "table", "output format, table or json")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if *dbPath == "" {
+		log.Fatalf("No keys database given, set -db, KEYS_DB_PATH or DB_PATH")
+	}
+	if *format != "table" && *format != "json" {
+		log.Fatalf("Unknown format %q, must be table or json", *format)
+	}
+
+	db, err := models.OpenKeysDatabase(*dbPath, *dataPath)
+	if err != nil {
+		log.Fatalf("Failed to open keys database: %v", err)
+	}
+	defer db.Close()
+
+	out := output{format: *format}
+	command, args := flag.Arg(0), flag.Args()[1:]
+
+	switch command {
+	case "list":
+		fs := flag.NewFlagSet("list", flag.ExitOnError)
+		fs.Parse(args)
+
+		keys, err := models.ListAPIKeys(db, 0)
+		check(err)
+		out.keys(keys)
+
+	case "show":
+		fs := flag.NewFlagSet("show", flag.ExitOnError)
+		member := fs.Int64("member", 0, "member ID")
+		fs.Parse(args)
+		requireFlag(fs, "member", *member)
+
+		keys, err := models.ListAPIKeys(db, *member)
+		check(err)
+		out.keys(keys)
+
+	case "issue":
+		fs := flag.NewFlagSet("issue", flag.ExitOnError)
+		member := fs.Int64("member", 0, "member ID")
+		scopes := fs.String("scopes", strings.Join(models.DefaultScopes, ","), "comma separated scopes, from "+strings.Join(models.AllScopes, ", "))
+		label := fs.String("label", "", "note saying what the key is for")
+		expiresIn := fs.Duration("expires-in", 0, "how long the key lasts, e.g. 2160h, or 0 for no expiry")
+		fs.Parse(args)
+		requireFlag(fs, "member", *member)
+
+		parsed, err := models.ParseScopes(*scopes)
+		check(err)
+
+		req := models.APIKeyRequest{MemberID: *member, Scopes: parsed, Label: *label}
+		if *expiresIn > 0 {
+			t := time.Now().Add(*expiresIn).UTC()
+			req.ExpiresAt = &t
+		}
+
+		if *dataPath != "" {
+			data, err := sql.Open("sqlite3", *dataPath)
+			check(err)
+			exists, err := models.MemberExists(data, strconv.FormatInt(*member, 10))
+			data.Close()
+			check(err)
+			if !exists {
+				check(models.ErrMemberNotFound)
+			}
+		} else {
+			log.Printf("Warning: no -data-db given, not checking member %d exists", *member)
+		}
+
+		key, secret, err := models.IssueAPIKey(db, req)
+		check(err)
+		out.issued(key, secret)
+
+	case "rotate":
+		fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+		id := fs.Int64("id", 0, "key ID")
+		fs.Parse(args)
+		requireFlag(fs, "id", *id)
+
+		key, secret, err := models.RotateAPIKey(db, *id)
+		check(err)
+		out.issued(key, secret)
+
+	case "revoke":
+		fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+		id := fs.Int64("id", 0, "key ID")
+		fs.Parse(args)
+		requireFlag(fs, "id", *id)
+
+		key, err := models.RevokeAPIKey(db, *id)
+		check(err)
+		out.keys([]*models.APIKey{key})
+
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		fs.Parse(args)
+
+		backup, err := models.ExportKeys(db)
+		check(err)
+		out.json(backup)
+
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			fmt.Fprintln(fs.Output(), "Usage: keys import FILE, or - for stdin")
+			os.Exit(2)
+		}
+
+		in := os.Stdin
+		if name := fs.Arg(0); name != "-" {
+			f, err := os.Open(name)
+			check(err)
+			defer f.Close()
+			in = f
+		}
+
+		var backup models.KeysBackup
+		if err := json.NewDecoder(in).Decode(&backup); err != nil {
+			log.Fatalf("Error reading export: %v", err)
+		}
+		check(models.ImportKeys(db, &backup))
+		log.Printf("Imported %d API keys, %d calendar feed tokens and %d calendar preferences",
+			len(backup.APIKeys), len(backup.FeedTokens), len(backup.CalendarPreferences))
+
+	default:
+		log.Printf("Unknown command %q", command)
+		usage()
+		os.Exit(2)
+	}
+}
+
+func requireFlag(fs *flag.FlagSet, name string, value int64) {
+	if value == 0 {
+		fmt.Fprintf(fs.Output(), "-%s is required\n", name)
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// check exits with a message for err, spelling out the errors an operator is
+// likely to hit
+func check(err error) {
+	switch {
+	case err == nil:
+		return
+	case errors.Is(err, models.ErrAPIKeyNotFound):
+		log.Fatalf("No such key")
+	case errors.Is(err, models.ErrAPIKeyRevoked):
+		log.Fatalf("Key is already revoked")
+	case errors.Is(err, models.ErrMemberNotFound):
+		log.Fatalf("No such member")
+	case errors.Is(err, models.ErrInvalidQuery):
+		log.Fatalf("%s", strings.TrimPrefix(err.Error(), models.ErrInvalidQuery.Error()+": "))
+	default:
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+type output struct {
+	format string
+}
+
+func (o output) json(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatalf("Error writing output: %v", err)
+	}
+}
+
+func (o output) keys(keys []*models.APIKey) {
+	if o.format == "json" {
+		o.json(keys)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tMEMBER\tPREFIX\tSTATUS\tSCOPES\tLABEL\tCREATED\tEXPIRES\tLAST USED")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			k.ID,
+			k.MemberID,
+			k.Prefix,
+			k.Status(),
+			strings.Join(k.Scopes, ","),
+			k.Label,
+			formatTime(&k.CreatedAt),
+			formatTime(k.ExpiresAt),
+			formatTime(k.LastUsedAt),
+		)
+	}
+	w.Flush()
+}
+
+func (o output) issued(key *models.APIKey, secret string) {
+	if o.format == "json" {
+		o.json(map[string]interface{}{"key": key, "secret": secret})
+		return
+	}
+
+	o.keys([]*models.APIKey{key})
+	fmt.Printf("\nSecret: %s\nThis is the only time it will be shown.\n", secret)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rossmackay/rockhoppers-db/models"
+)
+
+// registerHealthRoutes adds the unauthenticated liveness and readiness checks
+// used by Fly and the uptime monitor
+func registerHealthRoutes(r *gin.Engine, store *models.Database, thresholds map[string]time.Duration) {
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	r.GET("/readyz", func(c *gin.Context) {
+		readiness := models.CheckReadiness(store.DB(), thresholds)
+
+		c.Header("Cache-Control", "no-store")
+		if !readiness.Ready {
+			c.JSON(http.StatusServiceUnavailable, readiness)
+			return
+		}
+		c.JSON(http.StatusOK, readiness)
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rossmackay/rockhoppers-db/models"
+)
+
+// maxCachedKeys bounds the key cache, which also remembers keys that were
+// rejected
+const maxCachedKeys = 10000
+
+type cachedKey struct {
+	key     *models.APIKey
+	err     error
+	expires time.Time
+}
+
+// keyAuth looks up API keys, caching the results for ttl so most requests
+// don't touch SQLite, and applies the per-key rate limit and usage metering.
+// Keys revoked through the admin routes are dropped from the cache straight
+// away, but ones revoked with the keys command can keep working for up to ttl.
+type keyAuth struct {
+	db      *sql.DB
+	ttl     time.Duration
+	limiter *rateLimiter
+	usage   *usageMeter
+
+	mu    sync.Mutex
+	cache map[string]cachedKey
+}
+
+func newKeyAuth(db *sql.DB, ttl time.Duration, limiter *rateLimiter) *keyAuth {
+	return &keyAuth{
+		db:      db,
+		ttl:     ttl,
+		limiter: limiter,
+		usage:   newUsageMeter(db),
+		cache:   make(map[string]cachedKey),
+	}
+}
+
+// lookup authenticates a secret, from cache when possible
+func (a *keyAuth) lookup(secret string) (*models.APIKey, error) {
+	sum := sha256.Sum256([]byte(secret))
+	id := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	a.mu.Lock()
+	cached, ok := a.cache[id]
+	a.mu.Unlock()
+
+	if !ok || now.After(cached.expires) {
+		key, err := models.AuthenticateAPIKey(a.db, secret)
+		if err != nil && !errors.Is(err, models.ErrAPIKeyNotFound) &&
+			!errors.Is(err, models.ErrAPIKeyRevoked) && !errors.Is(err, models.ErrAPIKeyExpired) {
+			// Don't cache database errors
+			return nil, err
+		}
+
+		cached = cachedKey{key: key, err: err, expires: now.Add(a.ttl)}
+		a.mu.Lock()
+		if len(a.cache) >= maxCachedKeys {
+			a.cache = make(map[string]cachedKey)
+		}
+		a.cache[id] = cached
+		a.mu.Unlock()
+	}
+
+	// A cached key may have expired since it was looked up
+	if cached.err == nil && cached.key.Status() == "expired" {
+		return cached.key, models.ErrAPIKeyExpired
+	}
+	return cached.key, cached.err
+}
+
+// forget empties the cache after keys have changed
+func (a *keyAuth) forget() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cache = make(map[string]cachedKey)
+}
+
+// allow applies the per-key rate limit
+func (a *keyAuth) allow(key *models.APIKey) (bool, time.Duration) {
+	return a.limiter.allow(strconv.FormatInt(key.ID, 10))
+}
+
+type usageKey struct {
+	keyID int64
+	day   string
+}
+
+// usageMeter counts requests per key per day in memory and writes them to the
+// keys database in the background, so metering doesn't add a write to every
+// request
+type usageMeter struct {
+	db *sql.DB
+
+	mu       sync.Mutex
+	counts   map[usageKey]int64
+	lastUsed map[int64]time.Time
+}
+
+func newUsageMeter(db *sql.DB) *usageMeter {
+	return &usageMeter{
+		db:       db,
+		counts:   make(map[usageKey]int64),
+		lastUsed: make(map[int64]time.Time),
+	}
+}
+
+func (m *usageMeter) record(keyID int64) {
+	now := time.Now().UTC()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[usageKey{keyID: keyID, day: now.Format("2006-01-02")}]++
+	m.lastUsed[keyID] = now
+}
+
+// flush writes the counts gathered since the last flush. If that fails they
+// are kept for the next one.
+func (m *usageMeter) flush() {
+	m.mu.Lock()
+	counts, lastUsed := m.counts, m.lastUsed
+	m.counts = make(map[usageKey]int64)
+	m.lastUsed = make(map[int64]time.Time)
+	m.mu.Unlock()
+
+	if len(counts) == 0 {
+		return
+	}
+
+	usage := make([]models.APIKeyUsage, 0, len(counts))
+	for k, n := range counts {
+		usage = append(usage, models.APIKeyUsage{KeyID: k.keyID, Day: k.day, Requests: n})
+	}
+
+	if err := models.RecordAPIKeyUsage(m.db, usage, lastUsed); err != nil {
+		log.Println("Error recording API key usage:", err)
+
+		m.mu.Lock()
+		for k, n := range counts {
+			m.counts[k] += n
+		}
+		for id, t := range lastUsed {
+			if t.After(m.lastUsed[id]) {
+				m.lastUsed[id] = t
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// run flushes every interval until stop is closed
+func (m *usageMeter) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.flush()
+		}
+	}
+}
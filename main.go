@@ -1,90 +1,395 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/rossmackay/rockhoppers-db/models"
+	"github.com/rossmackay/rockhoppers-db/syncer"
 )
 
-func validateAPIKey(db *sql.DB) gin.HandlerFunc {
+// apiKeyFromRequest reads the key from the Authorization or X-API-Key header.
+// The api_key query parameter is still accepted for older clients, but ends up
+// in access logs so shouldn't be used for new ones.
+func apiKeyFromRequest(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); auth != "" {
+		scheme, key, ok := strings.Cut(auth, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(key)
+		}
+	}
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	return c.Query("api_key")
+}
+
+func validateAPIKey(auth *keyAuth) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		apiKey := c.Query("api_key")
+		apiKey := apiKeyFromRequest(c)
 		if apiKey == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key is required"})
 			return
 		}
 
-		var exists bool
-		query := "SELECT 1 FROM api_keys WHERE api_key = ?"
-		err := db.QueryRow(query, apiKey).Scan(&exists)
+		key, ok := authenticateAPIKey(c, auth, apiKey)
+		if !ok {
+			return
+		}
+
+		c.Set("member_id", key.MemberID)
+		c.Set("api_key", key)
+		c.Next()
+	}
+}
 
-		if err != nil {
+// authenticateAPIKey looks up the key, aborting with a 401 saying why if it
+// can't be used or a 429 if it is over its rate limit, and records the request
+// against it
+func authenticateAPIKey(c *gin.Context, auth *keyAuth, apiKey string) (*models.APIKey, bool) {
+	key, err := auth.lookup(apiKey)
+	switch {
+	case errors.Is(err, models.ErrAPIKeyRevoked), errors.Is(err, models.ErrAPIKeyExpired):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return nil, false
+	case err != nil:
+		if !errors.Is(err, models.ErrAPIKeyNotFound) {
 			log.Println(err)
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		return nil, false
+	}
+
+	if ok, retryAfter := auth.allow(key); !ok {
+		tooManyRequests(c, retryAfter)
+		return nil, false
+	}
+
+	auth.usage.record(key.ID)
+	return key, true
+}
+
+// requireScope rejects requests whose API key doesn't grant scope. It must
+// run after validateAPIKey.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := c.MustGet("api_key").(*models.APIKey)
+		if !ok || !key.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key does not have the %s scope", scope)})
 			return
 		}
+		c.Next()
+	}
+}
 
+// requireScopeToExpandSteward refuses expand=steward, which embeds member
+// details in meets, to keys that couldn't read those members directly
+func requireScopeToExpandSteward() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		expand, err := models.ParseExpandSteward(c.Request.URL.Query())
+		if err == nil && expand {
+			key, ok := c.MustGet("api_key").(*models.APIKey)
+			if !ok || !key.HasScope(models.ScopeReadMembers) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("expand=steward needs the %s scope", models.ScopeReadMembers)})
+				return
+			}
+		}
 		c.Next()
 	}
 }
 
+// feedPath is the route members' calendar subscriptions are served from
+const feedPath = "/calendar/feed/:token"
+
+// validateFeedToken authenticates calendar subscription URLs, which carry a
+// per-member feed token in the path instead of an API key. Feeds are limited
+// per token rather than per IP, since a calendar service polls many members'
+// feeds from the same addresses, but unknown tokens still count against the
+// IP so they can't be guessed any faster.
+func validateFeedToken(keysDB *sql.DB, tokenLimiter, ipLimiter *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimSuffix(c.Param("token"), ".ics")
+
+		memberID, err := models.GetMemberIDForFeedToken(keysDB, token)
+		if err != nil {
+			if !errors.Is(err, models.ErrFeedTokenNotFound) {
+				log.Println(err)
+			}
+			if ok, retryAfter := ipLimiter.allow(c.ClientIP()); !ok {
+				tooManyRequests(c, retryAfter)
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Calendar not found"})
+			return
+		}
+
+		if ok, retryAfter := tokenLimiter.allow(token); !ok {
+			tooManyRequests(c, retryAfter)
+			return
+		}
+
+		c.Set("member_id", memberID)
+		c.Next()
+	}
+}
+
+// calendarSubscriptionURLs builds the https and webcal URLs for a feed token
+func calendarSubscriptionURLs(c *gin.Context, token string) gin.H {
+	baseURL := os.Getenv("PUBLIC_BASE_URL")
+	if baseURL == "" {
+		scheme := "http"
+		if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		baseURL = fmt.Sprintf("%s://%s", scheme, c.Request.Host)
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	feedURL := fmt.Sprintf("%s/calendar/feed/%s.ics", baseURL, token)
+	webcalURL := "webcal://" + strings.TrimPrefix(strings.TrimPrefix(feedURL, "https://"), "http://")
+
+	return gin.H{"url": feedURL, "webcal_url": webcalURL}
+}
+
+// newSyncer sets up the in-process sync when MYSQL_DSN is configured, so the
+// API can refresh its own database instead of relying on a separate job
+func newSyncer(store *models.Database, dbPath, keysPath string) (*syncer.Syncer, error) {
+	mysqlDSN := os.Getenv("MYSQL_DSN")
+	if mysqlDSN == "" {
+		return nil, nil
+	}
+
+	cfg, err := syncer.LoadConfig(os.Getenv("SYNC_CONFIG"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := syncer.New(cfg, mysqlDSN, dbPath)
+	s.KeysDBPath = keysPath
+	// Pick up the new snapshot straight away rather than on the next poll
+	s.AfterSwap = func() {
+		if _, err := store.Reload(); err != nil {
+			log.Println("Error reopening database after sync:", err)
+		}
+	}
+	return s, nil
+}
+
 func main() {
 	dbPath := os.Getenv("DB_PATH")
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	log.Println("Attempting to connect to sqlite db at:", dbPath)
 
-	db, err := sql.Open("sqlite3", dbPath)
+	// API keys, calendar feed tokens and preferences are kept out of the
+	// synced file so they survive it being rebuilt from scratch
+	keysPath := os.Getenv("KEYS_DB_PATH")
+	if keysPath == "" {
+		keysPath = models.DefaultKeysPath(dbPath)
+	}
+	log.Println("Opening keys database at:", keysPath)
+
+	keysDB, err := models.OpenKeysDatabase(keysPath, dbPath)
+	if err != nil {
+		log.Fatal("Failed to open keys database:", err)
+	}
+	defer keysDB.Close()
+
+	// Members new in each snapshot get a key, as they did when the sync
+	// issued them
+	store, err := models.OpenDatabase(dbPath, func(db *sql.DB) error {
+		issued, err := models.IssueMissingAPIKeys(keysDB, db)
+		if issued > 0 {
+			log.Printf("Issued API keys for %d new members", issued)
+		}
+		return err
+	})
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+	defer store.Close()
+
+	// The sync swaps in a new snapshot file rather than writing to the live
+	// one, so keep an eye out for it and reopen when it lands
+	reloadInterval := 5 * time.Second
+	if v := os.Getenv("DB_RELOAD_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			reloadInterval = d
+		} else {
+			log.Println("Invalid DB_RELOAD_INTERVAL, using default:", v)
+		}
+	}
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	go store.Watch(reloadInterval, stopWatching)
+
+	if v := os.Getenv("SOCIAL_EVENT_DURATION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			models.SocialEventDuration = d
+		} else {
+			log.Println("Invalid SOCIAL_EVENT_DURATION, using default:", v)
+		}
+	}
+
+	if v := os.Getenv("SYNC_STALE_AFTER"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			models.SyncStaleAfter = d
+		} else {
+			log.Println("Invalid SYNC_STALE_AFTER, using default:", v)
+		}
+	}
+
+	// Narrow the member fields the API shares, e.g. "id,first_name"
+	if v := os.Getenv("MEMBER_PUBLIC_COLUMNS"); v != "" {
+		models.MemberPublicColumns = strings.Split(v, ",")
+	}
+
+	dbSyncer, err := newSyncer(store, dbPath, keysPath)
 	if err != nil {
-		log.Println("Failed to open database:", err)
+		log.Fatal("Failed to set up sync:", err)
+	}
+	if dbSyncer != nil && os.Getenv("SYNC_WATCH") == "true" {
+		go dbSyncer.Watch(ctx, syncer.WatchOptionsFromEnv())
 	}
-	defer db.Close()
 
-	if err := db.Ping(); err != nil {
-		log.Println("Failed to ping database:", err)
+	// Per-table limits on how long ago the last successful sync may be before
+	// /readyz fails, e.g. "meets=2h,members=48h"
+	readyThresholds, err := models.ParseSyncThresholds(os.Getenv("READY_SYNC_THRESHOLDS"))
+	if err != nil {
+		log.Println("Invalid READY_SYNC_THRESHOLDS, using default:", err)
+	}
+
+	// Key lookups are cached for this long, so a key revoked outside the
+	// admin routes can keep working until its entry expires
+	keyCacheTTL := time.Minute
+	if v := os.Getenv("API_KEY_CACHE_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			keyCacheTTL = d
+		} else {
+			log.Println("Invalid API_KEY_CACHE_TTL, using default:", v)
+		}
 	}
 
+	// Rate limits are requests per period, e.g. "300/1m", or "off"
+	perKeyLimit := rateLimitFromEnv("RATE_LIMIT_PER_KEY", rateLimit{requests: 300, per: time.Minute})
+	perIPLimit := rateLimitFromEnv("RATE_LIMIT_PER_IP", rateLimit{requests: 120, per: time.Minute})
+
+	usageFlushInterval := time.Minute
+	if v := os.Getenv("USAGE_FLUSH_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			usageFlushInterval = d
+		} else {
+			log.Println("Invalid USAGE_FLUSH_INTERVAL, using default:", v)
+		}
+	}
+
+	auth := newKeyAuth(keysDB, keyCacheTTL, newRateLimiter(perKeyLimit))
+	stopMetering := make(chan struct{})
+	go auth.usage.run(usageFlushInterval, stopMetering)
+
 	r := gin.Default()
+	// Never trust X-Forwarded-For, which any client can send to dodge the
+	// per-IP limit. Behind a proxy that puts the client's address in a header,
+	// e.g. Fly-Client-IP, take it from there instead.
+	if err := r.SetTrustedProxies(nil); err != nil {
+		log.Fatal("Failed to set trusted proxies:", err)
+	}
+	if header := os.Getenv("CLIENT_IP_HEADER"); header != "" {
+		r.TrustedPlatform = header
+	}
+
+	// Registered ahead of the rate limit so uptime checks are never refused
+	registerHealthRoutes(r, store, readyThresholds)
+
+	// Calendar feeds are limited by token instead, see validateFeedToken
+	ipLimiter := newRateLimiter(perIPLimit)
+	r.Use(ipRateLimit(ipLimiter, feedPath))
 
 	api := r.Group("/")
-	api.Use(validateAPIKey(db))
+	api.Use(validateAPIKey(auth))
+
+	meets := api.Group("/", requireScope(models.ScopeReadMeets))
+	members := api.Group("/", requireScope(models.ScopeReadMembers))
 
 	{
-		api.GET("/meets", func(c *gin.Context) {
-			meets, err := models.GetAllMeets(db)
+		meets.GET("/meets", requireScopeToExpandSteward(), conditionalGet(store), func(c *gin.Context) {
+			query, err := models.ParseListQuery(c.Request.URL.Query())
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			page, err := models.ListMeets(store.DB(), query)
+			if errors.Is(err, models.ErrInvalidQuery) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(http.StatusOK, meets)
+			c.JSON(http.StatusOK, page)
 		})
 
-		api.GET("/meets/:id", func(c *gin.Context) {
+		meets.GET("/meets/:id", requireScopeToExpandSteward(), conditionalGet(store), func(c *gin.Context) {
+			expandSteward, err := models.ParseExpandSteward(c.Request.URL.Query())
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
 			id := c.Param("id")
-			meet, err := models.GetMeetByID(db, id)
+			meet, err := models.GetMeetByID(store.DB(), id)
 			if err != nil {
 				c.JSON(http.StatusNotFound, gin.H{"error": "Meet not found"})
 				return
 			}
+
+			if expandSteward {
+				if err := models.ExpandMeetStewards(store.DB(), meet); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+			}
 			c.JSON(http.StatusOK, meet)
 		})
 
-		api.GET("/socials", func(c *gin.Context) {
-			socials, err := models.GetAllSocials(db)
+		meets.GET("/socials", conditionalGet(store), func(c *gin.Context) {
+			query, err := models.ParseListQuery(c.Request.URL.Query())
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			page, err := models.ListSocials(store.DB(), query)
+			if errors.Is(err, models.ErrInvalidQuery) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(http.StatusOK, socials)
+			c.JSON(http.StatusOK, page)
 		})
 
-		api.GET("/socials/:id", func(c *gin.Context) {
+		meets.GET("/socials/:id", conditionalGet(store), func(c *gin.Context) {
 			id := c.Param("id")
-			social, err := models.GetSocialByID(db, id)
+			social, err := models.GetSocialByID(store.DB(), id)
 			if err != nil {
 				c.JSON(http.StatusNotFound, gin.H{"error": "Social not found"})
 				return
@@ -92,44 +397,172 @@ func main() {
 			c.JSON(http.StatusOK, social)
 		})
 
+		members.GET("/members/:id", conditionalGet(store), func(c *gin.Context) {
+			id := c.Param("id")
+			member, err := models.GetPublicMemberByID(store.DB(), id)
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+				return
+			}
+			c.JSON(http.StatusOK, member)
+		})
+
+		// Not conditional: failed runs and staleness change without changing
+		// the data version the ETags are based on. Without history this is the
+		// plain list of tables it has always been; asking for history wraps
+		// the tables in an object alongside the most recent runs.
 		api.GET("/sync-status", func(c *gin.Context) {
-			metadata, err := models.GetAllSyncMetadata(db)
+			metadata, err := models.GetAllSyncMetadata(store.DB())
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(http.StatusOK, metadata)
+
+			if !c.Request.URL.Query().Has("history") {
+				c.JSON(http.StatusOK, metadata)
+				return
+			}
+
+			history, err := models.ParseSyncHistory(c.Request.URL.Query())
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			runs, err := models.GetSyncRuns(store.DB(), history)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			stale := false
+			for _, m := range metadata {
+				stale = stale || m.Stale
+			}
+
+			c.JSON(http.StatusOK, gin.H{"stale": stale, "tables": metadata, "runs": runs})
+		})
+
+		api.GET("/calendar-subscription", func(c *gin.Context) {
+			token, err := models.GetOrCreateFeedToken(keysDB, c.GetInt64("member_id"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, calendarSubscriptionURLs(c, token.Token))
+		})
+
+		api.POST("/calendar-subscription/rotate", func(c *gin.Context) {
+			token, err := models.RotateFeedToken(keysDB, c.GetInt64("member_id"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, calendarSubscriptionURLs(c, token.Token))
+		})
+
+		api.DELETE("/calendar-subscription", func(c *gin.Context) {
+			if err := models.RevokeFeedToken(keysDB, c.GetInt64("member_id")); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.Status(http.StatusNoContent)
+		})
+
+		api.GET("/calendar-preferences", func(c *gin.Context) {
+			prefs, err := models.GetCalendarPreferences(keysDB, c.GetInt64("member_id"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, prefs)
+		})
+
+		api.PUT("/calendar-preferences", func(c *gin.Context) {
+			var prefs models.CalendarPreferences
+			if err := c.ShouldBindJSON(&prefs); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			err := models.SaveCalendarPreferences(keysDB, c.GetInt64("member_id"), prefs)
+			if errors.Is(err, models.ErrInvalidQuery) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			saved, err := models.GetCalendarPreferences(keysDB, c.GetInt64("member_id"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, saved)
 		})
 	}
 
+	calendarCache := newFeedCache()
+
 	r.GET("/calendar", func(c *gin.Context) {
-		icsData, err := models.GenerateCalendar(db)
+		opts, err := models.ParseCalendarOptions(c.Request.URL.Query())
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.Header("Content-Type", "text/calendar; charset=utf-8")
-		c.Header("Content-Disposition", "attachment; filename=rockhoppers-meets.ics")
-		c.String(http.StatusOK, icsData)
+		serveCalendar(c, store, calendarCache, opts)
 	})
 
-	r.GET("/calendar/:member_id", func(c *gin.Context) {
-		member_id := c.Param("member_id")
-		icsData, err := models.GenerateCalendar(db, member_id)
+	r.GET(feedPath, validateFeedToken(keysDB, newRateLimiter(perKeyLimit), ipLimiter), func(c *gin.Context) {
+		opts, err := models.ParseCalendarOptions(c.Request.URL.Query())
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		opts.MemberID = strconv.FormatInt(c.GetInt64("member_id"), 10)
 
-		c.Header("Content-Type", "text/calendar; charset=utf-8")
-		c.Header("Content-Disposition", "attachment; filename=rockhoppers-meets.ics")
-		c.String(http.StatusOK, icsData)
+		// The member's saved preferences apply unless the URL overrides them
+		if !c.Request.URL.Query().Has("reminders") {
+			prefs, err := models.GetCalendarPreferences(keysDB, c.GetInt64("member_id"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			opts.SetBookingReminders(prefs.BookingReminders)
+		}
+
+		serveCalendar(c, store, calendarCache, opts)
 	})
 
+	admin := r.Group("/admin")
+	admin.Use(validateAdminKey(auth, os.Getenv("ADMIN_API_KEY")))
+
+	registerKeyAdminRoutes(admin, store, auth)
+	if dbSyncer != nil {
+		registerSyncAdminRoutes(admin, ctx, dbSyncer)
+	}
+
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
 	log.Println("Starting server on http://localhost:8080")
 
-	if err := r.Run(":8080"); err != nil {
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatal("Failed to start server:", err)
 	}
+
+	// Wait for in-flight requests so their usage is counted in the last flush
+	<-shutdown
+	close(stopMetering)
+	auth.usage.flush()
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rossmackay/rockhoppers-db/models"
+)
+
+// scopeTestRouter serves the meets and members routes behind the same scope
+// checks as the API, for a request made with a key granting scopes
+func scopeTestRouter(scopes ...string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("api_key", &models.APIKey{ID: 1, Scopes: scopes})
+	})
+
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	meets := r.Group("/", requireScope(models.ScopeReadMeets))
+	members := r.Group("/", requireScope(models.ScopeReadMembers))
+	meets.GET("/meets", requireScopeToExpandSteward(), ok)
+	members.GET("/members/:id", ok)
+	return r
+}
+
+func TestScopeEnforcement(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		path   string
+		want   int
+	}{
+		{[]string{models.ScopeReadMeets}, "/meets", http.StatusOK},
+		{[]string{models.ScopeReadMeets}, "/members/7", http.StatusForbidden},
+		{[]string{models.ScopeReadMembers}, "/meets", http.StatusForbidden},
+		{[]string{models.ScopeReadMembers}, "/members/7", http.StatusOK},
+		{models.DefaultScopes, "/meets", http.StatusOK},
+		{models.DefaultScopes, "/members/7", http.StatusOK},
+		{[]string{models.ScopeAdmin}, "/members/7", http.StatusOK},
+		{nil, "/meets", http.StatusForbidden},
+
+		// Expanding stewards embeds members, so it needs read:members too
+		{[]string{models.ScopeReadMeets}, "/meets?expand=steward", http.StatusForbidden},
+		{models.DefaultScopes, "/meets?expand=steward", http.StatusOK},
+		{[]string{models.ScopeAdmin}, "/meets?expand=steward", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		scopeTestRouter(tt.scopes...).ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("GET %s with %v = %d, want %d", tt.path, tt.scopes, w.Code, tt.want)
+		}
+	}
+}
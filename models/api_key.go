@@ -0,0 +1,714 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// API key scopes. Admin covers every other scope.
+const (
+	ScopeReadMeets   = "read:meets"
+	ScopeReadMembers = "read:members"
+	ScopeAdmin       = "admin"
+)
+
+// AllScopes lists the scopes a key can be issued with
+var AllScopes = []string{ScopeReadMeets, ScopeReadMembers, ScopeAdmin}
+
+// DefaultScopes are given to keys issued without any, and to the plaintext
+// keys migrated from before scopes existed, which could read everything but
+// the admin routes
+var DefaultScopes = []string{ScopeReadMeets, ScopeReadMembers}
+
+// APIKeyPrefixLength is how much of a key is stored in the clear so it can be
+// looked up and recognised in listings
+const APIKeyPrefixLength = 12
+
+const createAPIKeysTable = `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		member_id INTEGER NOT NULL,
+		key_prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL,
+		salt TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		label TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		last_used_at TIMESTAMP
+	)
+`
+
+// apiKeyLifecycleColumns were added after the table was first created
+var apiKeyLifecycleColumns = []string{
+	"label TEXT NOT NULL DEFAULT ''",
+	"expires_at TIMESTAMP",
+	"revoked_at TIMESTAMP",
+	"last_used_at TIMESTAMP",
+}
+
+const apiKeyColumns = "id, member_id, key_prefix, scopes, label, created_at, expires_at, revoked_at, last_used_at"
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrAPIKeyRevoked  = errors.New("API key has been revoked")
+	ErrAPIKeyExpired  = errors.New("API key has expired")
+)
+
+// APIKey is a stored key. Only a salted hash of the secret is kept, so the
+// full key can't be recovered once it has been handed out.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	MemberID   int64      `json:"member_id"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	Label      string     `json:"label"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// APIKeyRequest describes a key to issue. Keys without an expiry last until
+// they are revoked.
+type APIKeyRequest struct {
+	MemberID  int64      `json:"member_id"`
+	Scopes    []string   `json:"scopes"`
+	Label     string     `json:"label"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Status is "active", "expired" or "revoked"
+func (k *APIKey) Status() string {
+	switch {
+	case k.RevokedAt != nil:
+		return "revoked"
+	case k.ExpiresAt != nil && !time.Now().Before(*k.ExpiresAt):
+		return "expired"
+	default:
+		return "active"
+	}
+}
+
+// usable returns why the key can't be used, if it can't
+func (k *APIKey) usable() error {
+	switch k.Status() {
+	case "revoked":
+		return ErrAPIKeyRevoked
+	case "expired":
+		return ErrAPIKeyExpired
+	}
+	return nil
+}
+
+// HasScope reports whether the key grants scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// EnsureAPIKeysTable creates the api_keys table, first hashing any plaintext
+// keys left by older versions so existing clients keep working
+func EnsureAPIKeysTable(db *sql.DB) error {
+	// Not tableColumns, whose cache assumes the schema is fixed while the
+	// database is open
+	var plaintext int
+	err := db.QueryRow("SELECT count(*) FROM pragma_table_info('api_keys') WHERE name = 'api_key'").Scan(&plaintext)
+	if err != nil {
+		return err
+	}
+	if plaintext > 0 {
+		if err := migratePlaintextAPIKeys(db); err != nil {
+			return fmt.Errorf("failed to migrate plaintext API keys: %v", err)
+		}
+	}
+
+	_, err = db.Exec(createAPIKeysTable)
+	if err != nil {
+		return fmt.Errorf("failed to create api_keys table: %v", err)
+	}
+
+	for _, column := range apiKeyLifecycleColumns {
+		name := strings.Fields(column)[0]
+		var exists int
+		err := db.QueryRow("SELECT count(*) FROM pragma_table_info('api_keys') WHERE name = ?", name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			if _, err := db.Exec("ALTER TABLE api_keys ADD COLUMN " + column); err != nil {
+				return fmt.Errorf("failed to add api_keys.%s: %v", name, err)
+			}
+		}
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS api_keys_prefix ON api_keys (key_prefix)")
+	if err != nil {
+		return fmt.Errorf("failed to create api_keys index: %v", err)
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS api_keys_member ON api_keys (member_id)")
+	if err != nil {
+		return fmt.Errorf("failed to create api_keys index: %v", err)
+	}
+
+	return nil
+}
+
+func migratePlaintextAPIKeys(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("ALTER TABLE api_keys RENAME TO api_keys_plaintext"); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(createAPIKeysTable)
+	if err != nil {
+		return err
+	}
+
+	keys, err := readPlaintextAPIKeys(tx, "api_keys_plaintext")
+	if err != nil {
+		return err
+	}
+	if err := insertHashedAPIKeys(tx, keys); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DROP TABLE api_keys_plaintext"); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Hashed %d plaintext API keys", len(keys))
+	return nil
+}
+
+// plaintextKey is a row of api_keys from before keys were hashed
+type plaintextKey struct {
+	memberID  int64
+	key       string
+	createdAt sql.NullString
+}
+
+func readPlaintextAPIKeys(tx *sql.Tx, table string) ([]plaintextKey, error) {
+	rows, err := tx.Query(fmt.Sprintf("SELECT member_id, api_key, created_at FROM %s", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []plaintextKey
+	for rows.Next() {
+		var k plaintextKey
+		if err := rows.Scan(&k.memberID, &k.key, &k.createdAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// insertHashedAPIKeys stores plaintext keys in api_keys as salted hashes with
+// the default scopes
+func insertHashedAPIKeys(tx *sql.Tx, keys []plaintextKey) error {
+	for _, k := range keys {
+		salt, err := randomHex(16)
+		if err != nil {
+			return err
+		}
+		createdAt := k.createdAt.String
+		if !k.createdAt.Valid {
+			createdAt = time.Now().UTC().Format(time.RFC3339)
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO api_keys (member_id, key_prefix, key_hash, salt, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+			k.memberID,
+			apiKeyPrefix(k.key),
+			hashAPIKey(salt, k.key),
+			salt,
+			strings.Join(DefaultScopes, " "),
+			createdAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func apiKeyPrefix(key string) string {
+	if len(key) <= APIKeyPrefixLength {
+		return key
+	}
+	return key[:APIKeyPrefixLength]
+}
+
+func hashAPIKey(salt, key string) string {
+	sum := sha256.Sum256([]byte(salt + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseScopes splits a comma or space separated scope list, rejecting scopes
+// that don't exist. An empty list gives DefaultScopes.
+func ParseScopes(value string) ([]string, error) {
+	var scopes []string
+	seen := make(map[string]bool)
+
+	for _, scope := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		known := false
+		for _, s := range AllScopes {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, invalidQuery("unknown scope %q, must be one of %s", scope, strings.Join(AllScopes, ", "))
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if len(scopes) == 0 {
+		return append([]string(nil), DefaultScopes...), nil
+	}
+	return scopes, nil
+}
+
+func parseKeyTime(s sql.NullString) *time.Time {
+	t, ok := parseSyncTime(s)
+	if !ok {
+		return nil
+	}
+	return &t
+}
+
+func formatKeyTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.UTC().Format(time.RFC3339), Valid: true}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanAPIKey reads the apiKeyColumns, followed by any extra destinations
+func scanAPIKey(row rowScanner, extra ...interface{}) (*APIKey, error) {
+	var k APIKey
+	var scopes string
+	var createdAt, expiresAt, revokedAt, lastUsedAt sql.NullString
+
+	dest := []interface{}{&k.ID, &k.MemberID, &k.Prefix, &scopes, &k.Label, &createdAt, &expiresAt, &revokedAt, &lastUsedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	k.Scopes = strings.Fields(scopes)
+	if parsed := parseKeyTime(createdAt); parsed != nil {
+		k.CreatedAt = *parsed
+	}
+	k.ExpiresAt = parseKeyTime(expiresAt)
+	k.RevokedAt = parseKeyTime(revokedAt)
+	k.LastUsedAt = parseKeyTime(lastUsedAt)
+	return &k, nil
+}
+
+// IssueAPIKey creates a key and returns it along with the full secret, which
+// is only available at this point. Members live in the synced database, so
+// callers should check the member exists first with MemberExists.
+func IssueAPIKey(db *sql.DB, req APIKeyRequest) (*APIKey, string, error) {
+	scopes, err := ParseScopes(strings.Join(req.Scopes, " "))
+	if err != nil {
+		return nil, "", err
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, "", invalidQuery("expires_at must be in the future")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	key, secret, err := insertAPIKey(tx, req.MemberID, scopes, req.Label, req.ExpiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, secret, tx.Commit()
+}
+
+// AutoIssuedKeyLabel labels the keys IssueMissingAPIKeys creates
+const AutoIssuedKeyLabel = "Issued automatically"
+
+// IssueMissingAPIKeys gives every member in the synced database who has never
+// had a key one with the default scopes, as the sync did before keys were
+// hashed. Members whose keys were all revoked aren't given another. Only the
+// hash is kept, so the secret is handed out by rotating the key, which keeps
+// its scopes.
+func IssueMissingAPIKeys(keysDB, dataDB *sql.DB) (int, error) {
+	if _, err := tableColumns(dataDB, "members"); err != nil {
+		return 0, nil
+	}
+
+	rows, err := dataDB.Query("SELECT id FROM members")
+	if err != nil {
+		return 0, err
+	}
+	var members []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		members = append(members, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := keysDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	issued := 0
+	for _, id := range members {
+		var keys int
+		if err := tx.QueryRow("SELECT count(*) FROM api_keys WHERE member_id = ?", id).Scan(&keys); err != nil {
+			return 0, err
+		}
+		if keys > 0 {
+			continue
+		}
+		if _, _, err := insertAPIKey(tx, id, DefaultScopes, AutoIssuedKeyLabel, nil); err != nil {
+			return 0, fmt.Errorf("error issuing API key for member %d: %v", id, err)
+		}
+		issued++
+	}
+
+	return issued, tx.Commit()
+}
+
+func insertAPIKey(tx *sql.Tx, memberID int64, scopes []string, label string, expiresAt *time.Time) (*APIKey, string, error) {
+	secret, err := randomHex(24)
+	if err != nil {
+		return nil, "", fmt.Errorf("error generating API key: %v", err)
+	}
+	key := "rmc_" + secret
+
+	salt, err := randomHex(16)
+	if err != nil {
+		return nil, "", fmt.Errorf("error generating API key salt: %v", err)
+	}
+
+	res, err := tx.Exec(
+		"INSERT INTO api_keys (member_id, key_prefix, key_hash, salt, scopes, label, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		memberID,
+		apiKeyPrefix(key),
+		hashAPIKey(salt, key),
+		salt,
+		strings.Join(scopes, " "),
+		label,
+		time.Now().UTC().Format(time.RFC3339),
+		formatKeyTime(expiresAt),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, "", err
+	}
+
+	issued, err := scanAPIKey(tx.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?", id))
+	if err != nil {
+		return nil, "", err
+	}
+	return issued, key, nil
+}
+
+// GetAPIKey returns a key by its ID
+func GetAPIKey(db *sql.DB, id int64) (*APIKey, error) {
+	k, err := scanAPIKey(db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyNotFound
+	}
+	return k, err
+}
+
+// ListAPIKeys returns every key, or just the member's if memberID is non-zero,
+// newest first
+func ListAPIKeys(db *sql.DB, memberID int64) ([]*APIKey, error) {
+	query := "SELECT " + apiKeyColumns + " FROM api_keys"
+	var args []interface{}
+	if memberID != 0 {
+		query += " WHERE member_id = ?"
+		args = append(args, memberID)
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RotateAPIKey revokes a key and issues a replacement with the same member,
+// scopes and label. A key that expired keeps its original lifetime, counted
+// from now.
+func RotateAPIKey(db *sql.DB, id int64) (*APIKey, string, error) {
+	old, err := GetAPIKey(db, id)
+	if err != nil {
+		return nil, "", err
+	}
+	if old.RevokedAt != nil {
+		return nil, "", ErrAPIKeyRevoked
+	}
+
+	var expiresAt *time.Time
+	if old.ExpiresAt != nil {
+		t := time.Now().Add(old.ExpiresAt.Sub(old.CreatedAt)).UTC()
+		expiresAt = &t
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	if err := revokeAPIKey(tx, id); err != nil {
+		return nil, "", err
+	}
+
+	key, secret, err := insertAPIKey(tx, old.MemberID, old.Scopes, old.Label, expiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, secret, tx.Commit()
+}
+
+// RevokeAPIKey stops a key working. Revoked keys are kept so they show up in
+// listings.
+func RevokeAPIKey(db *sql.DB, id int64) (*APIKey, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := revokeAPIKey(tx, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetAPIKey(db, id)
+}
+
+func revokeAPIKey(tx *sql.Tx, id int64) error {
+	var revokedAt sql.NullString
+	err := tx.QueryRow("SELECT revoked_at FROM api_keys WHERE id = ?", id).Scan(&revokedAt)
+	if err == sql.ErrNoRows {
+		return ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if revokedAt.Valid {
+		return ErrAPIKeyRevoked
+	}
+
+	_, err = tx.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ?", time.Now().UTC().Format(time.RFC3339), id)
+	return err
+}
+
+// AuthenticateAPIKey finds the stored key matching the secret presented. It
+// returns ErrAPIKeyRevoked or ErrAPIKeyExpired for keys that match but can no
+// longer be used.
+func AuthenticateAPIKey(db *sql.DB, key string) (*APIKey, error) {
+	rows, err := db.Query(
+		"SELECT "+apiKeyColumns+", key_hash, salt FROM api_keys WHERE key_prefix = ?",
+		apiKeyPrefix(key),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Prefixes aren't unique, so check every candidate
+	for rows.Next() {
+		var hash, salt string
+		k, err := scanAPIKey(rows, &hash, &salt)
+		if err != nil {
+			return nil, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(hashAPIKey(salt, key)), []byte(hash)) != 1 {
+			continue
+		}
+
+		return k, k.usable()
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, ErrAPIKeyNotFound
+}
+
+// ExportedAPIKey is a key as backed up by ExportAPIKeys, with the hash and salt
+// needed to restore it
+type ExportedAPIKey struct {
+	APIKey
+	KeyHash string `json:"key_hash"`
+	Salt    string `json:"salt"`
+}
+
+// ExportAPIKeys returns every key along with its hash and salt. The output is
+// as sensitive as a password database.
+func ExportAPIKeys(db *sql.DB) ([]ExportedAPIKey, error) {
+	rows, err := db.Query("SELECT " + apiKeyColumns + ", key_hash, salt FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []ExportedAPIKey{}
+	for rows.Next() {
+		var e ExportedAPIKey
+		k, err := scanAPIKey(rows, &e.KeyHash, &e.Salt)
+		if err != nil {
+			return nil, err
+		}
+		e.APIKey = *k
+		keys = append(keys, e)
+	}
+	return keys, rows.Err()
+}
+
+// APIKeyUsage is how many requests a key made on one day, in UTC
+type APIKeyUsage struct {
+	KeyID    int64  `json:"key_id"`
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+}
+
+func EnsureAPIKeyUsageTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS api_key_usage (
+			key_id INTEGER NOT NULL,
+			day TEXT NOT NULL,
+			requests INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (key_id, day)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create api_key_usage table: %v", err)
+	}
+	return nil
+}
+
+// RecordAPIKeyUsage adds request counts to the daily totals and moves each
+// key's last_used_at forward
+func RecordAPIKeyUsage(db *sql.DB, usage []APIKeyUsage, lastUsed map[int64]time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, u := range usage {
+		_, err := tx.Exec(`
+			INSERT INTO api_key_usage (key_id, day, requests) VALUES (?, ?, ?)
+			ON CONFLICT (key_id, day) DO UPDATE SET requests = requests + excluded.requests
+		`, u.KeyID, u.Day, u.Requests)
+		if err != nil {
+			return err
+		}
+	}
+
+	for id, t := range lastUsed {
+		used := t.UTC().Format(time.RFC3339)
+		_, err := tx.Exec(
+			"UPDATE api_keys SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)",
+			used, id, used,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAPIKeyUsage returns a key's daily request counts for the last days days,
+// most recent first
+func GetAPIKeyUsage(db *sql.DB, id int64, days int) ([]APIKeyUsage, error) {
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Format("2006-01-02")
+	rows, err := db.Query(
+		"SELECT key_id, day, requests FROM api_key_usage WHERE key_id = ? AND day >= ? ORDER BY day DESC",
+		id, since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []APIKeyUsage{}
+	for rows.Next() {
+		var u APIKeyUsage
+		if err := rows.Scan(&u.KeyID, &u.Day, &u.Requests); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
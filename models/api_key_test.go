@@ -0,0 +1,187 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestKeys(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if err := EnsureAPIKeysTable(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	db := openTestKeys(t)
+
+	key, secret, err := IssueAPIKey(db, APIKeyRequest{MemberID: 7, Scopes: []string{ScopeReadMeets}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, otherSecret, err := IssueAPIKey(db, APIKeyRequest{MemberID: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the prefix is stored in the clear, and each key has its own salt
+	var prefix, hash, salt string
+	if err := db.QueryRow("SELECT key_prefix, key_hash, salt FROM api_keys WHERE id = ?", key.ID).Scan(&prefix, &hash, &salt); err != nil {
+		t.Fatal(err)
+	}
+	if prefix != secret[:APIKeyPrefixLength] || key.Prefix != prefix {
+		t.Errorf("prefix = %q, want the first %d characters of %q", prefix, APIKeyPrefixLength, secret)
+	}
+	if strings.Contains(hash, secret) || hash != hashAPIKey(salt, secret) {
+		t.Errorf("key_hash %q isn't the salted hash of the key", hash)
+	}
+	var otherSalt string
+	if err := db.QueryRow("SELECT salt FROM api_keys WHERE id = ?", other.ID).Scan(&otherSalt); err != nil {
+		t.Fatal(err)
+	}
+	if salt == otherSalt {
+		t.Error("two keys were given the same salt")
+	}
+
+	// Another key sharing the prefix mustn't get in the way of the lookup
+	if _, err := db.Exec(
+		"INSERT INTO api_keys (member_id, key_prefix, key_hash, salt, scopes) VALUES (9, ?, ?, 'salt', ?)",
+		prefix, hashAPIKey("salt", prefix+"different"), ScopeAdmin,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		secret     string
+		wantMember int64
+		wantErr    error
+	}{
+		{"key", secret, 7, nil},
+		{"other key", otherSecret, 8, nil},
+		{"same prefix, wrong secret", prefix + "wrong", 0, ErrAPIKeyNotFound},
+		{"unknown prefix", "rmc_unknown", 0, ErrAPIKeyNotFound},
+		{"empty", "", 0, ErrAPIKeyNotFound},
+	}
+
+	for _, tt := range tests {
+		got, err := AuthenticateAPIKey(db, tt.secret)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: AuthenticateAPIKey error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr == nil && got.MemberID != tt.wantMember {
+			t.Errorf("%s: AuthenticateAPIKey found member %d's key, want member %d's", tt.name, got.MemberID, tt.wantMember)
+		}
+	}
+}
+
+func TestAuthenticateAPIKeyLifecycle(t *testing.T) {
+	db := openTestKeys(t)
+
+	revoked, revokedSecret, err := IssueAPIKey(db, APIKeyRequest{MemberID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RevokeAPIKey(db, revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour)
+	expired, expiredSecret, err := IssueAPIKey(db, APIKeyRequest{MemberID: 7, ExpiresAt: &expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Backdate it to an hour long key that ran out a minute ago
+	if _, err := db.Exec(
+		"UPDATE api_keys SET created_at = ?, expires_at = ? WHERE id = ?",
+		time.Now().Add(-61*time.Minute).UTC().Format(time.RFC3339),
+		time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+		expired.ID,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AuthenticateAPIKey(db, revokedSecret); !errors.Is(err, ErrAPIKeyRevoked) {
+		t.Errorf("revoked key: error = %v, want %v", err, ErrAPIKeyRevoked)
+	}
+	if _, err := AuthenticateAPIKey(db, expiredSecret); !errors.Is(err, ErrAPIKeyExpired) {
+		t.Errorf("expired key: error = %v, want %v", err, ErrAPIKeyExpired)
+	}
+
+	// Rotating hands out a new secret and the old one stops working
+	rotated, rotatedSecret, err := RotateAPIKey(db, expired.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := AuthenticateAPIKey(db, rotatedSecret); err != nil || got.ID != rotated.ID {
+		t.Errorf("rotated key: AuthenticateAPIKey = %+v, %v, want key %d", got, err, rotated.ID)
+	}
+	if _, err := AuthenticateAPIKey(db, expiredSecret); !errors.Is(err, ErrAPIKeyRevoked) {
+		t.Errorf("replaced key: error = %v, want %v", err, ErrAPIKeyRevoked)
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{[]string{ScopeReadMeets}, ScopeReadMeets, true},
+		{[]string{ScopeReadMeets}, ScopeReadMembers, false},
+		{[]string{ScopeReadMeets}, ScopeAdmin, false},
+		{DefaultScopes, ScopeReadMembers, true},
+		{DefaultScopes, ScopeAdmin, false},
+		// admin grants everything
+		{[]string{ScopeAdmin}, ScopeReadMembers, true},
+		{nil, ScopeReadMeets, false},
+	}
+
+	for _, tt := range tests {
+		k := &APIKey{Scopes: tt.scopes}
+		if got := k.HasScope(tt.scope); got != tt.want {
+			t.Errorf("%v HasScope(%q) = %v, want %v", tt.scopes, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		ok   bool
+	}{
+		{"", DefaultScopes, true},
+		{"read:meets", []string{ScopeReadMeets}, true},
+		{"read:meets, read:members read:meets", []string{ScopeReadMeets, ScopeReadMembers}, true},
+		{"admin", []string{ScopeAdmin}, true},
+		{"write:meets", nil, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseScopes(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseScopes(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("ParseScopes(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if !tt.ok && !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("ParseScopes(%q) error = %v, want an invalid query", tt.in, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+)
+
+var ErrMemberNotFound = errors.New("member not found")
+
+const (
+	BookingStatusBooked     = "booked"
+	BookingStatusWaitlisted = "waitlisted"
+	BookingStatusCancelled  = "cancelled"
+)
+
+type Booking struct {
+	MeetID   int64  `json:"meet_id"`
+	MemberID int64  `json:"member_id"`
+	Status   string `json:"status"`
+}
+
+// bookingStatuses maps the status values used in the bookings table, lower
+// cased, onto booked, waitlisted or cancelled
+var bookingStatuses = map[string]string{
+	"booked":       BookingStatusBooked,
+	"confirmed":    BookingStatusBooked,
+	"paid":         BookingStatusBooked,
+	"waiting list": BookingStatusWaitlisted,
+	"waiting_list": BookingStatusWaitlisted,
+	"waitlist":     BookingStatusWaitlisted,
+	"waitlisted":   BookingStatusWaitlisted,
+	"cancelled":    BookingStatusCancelled,
+	"canceled":     BookingStatusCancelled,
+	"withdrawn":    BookingStatusCancelled,
+}
+
+// normaliseBookingStatus maps a bookings table status onto booked, waitlisted
+// or cancelled. It reports false for NULL or unrecognised values, which
+// shouldn't be guessed at since they'd put meets in members' calendars.
+func normaliseBookingStatus(status sql.NullString) (string, bool) {
+	if !status.Valid {
+		return "", false
+	}
+	s, ok := bookingStatuses[strings.ToLower(strings.TrimSpace(status.String))]
+	return s, ok
+}
+
+func MemberExists(db *sql.DB, memberID string) (bool, error) {
+	var exists int
+	err := db.QueryRow("SELECT 1 FROM members WHERE id = ?", memberID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetActiveBookingsForMember returns the member's booked and waitlisted
+// bookings keyed by meet id. Cancelled bookings and ones with a status that
+// isn't recognised are left out.
+func GetActiveBookingsForMember(db *sql.DB, memberID string) (map[int64]Booking, error) {
+	rows, err := db.Query("SELECT meet_id, member_id, status FROM bookings WHERE member_id = ?", memberID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookings := make(map[int64]Booking)
+	for rows.Next() {
+		var b Booking
+		var status sql.NullString
+
+		if err := rows.Scan(&b.MeetID, &b.MemberID, &status); err != nil {
+			return nil, err
+		}
+
+		var ok bool
+		if b.Status, ok = normaliseBookingStatus(status); !ok {
+			log.Printf("Warning: skipping booking of meet %d by member %d with unrecognised status %q", b.MeetID, b.MemberID, status.String)
+			continue
+		}
+		if b.Status == BookingStatusCancelled {
+			continue
+		}
+
+		// A member can have more than one booking row for a meet (e.g. moved
+		// off the waiting list), a confirmed place always wins
+		if existing, ok := bookings[b.MeetID]; ok && existing.Status == BookingStatusBooked {
+			continue
+		}
+		bookings[b.MeetID] = b
+	}
+
+	return bookings, rows.Err()
+}
@@ -3,19 +3,109 @@ package models
 import (
 	"database/sql"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	ics "github.com/arran4/golang-ical"
 )
 
-func createCalendarEvent(meet Meet, lastSyncTime time.Time) *ics.VEvent {
+// memberMeet describes how a member is involved in a meet, for personalised feeds
+type memberMeet struct {
+	Booking *Booking
+	Steward bool
+}
+
+const (
+	CategoryMeet   = "Meet"
+	CategorySocial = "Social"
+	CategoryNonLMC = "Non-LMC"
+	CategoryFull   = "Full"
+)
+
+// sequenceEpoch anchors SEQUENCE numbers, which are the minutes between it and
+// an event's updated_at so they increase every time the event is edited
+var sequenceEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// setRevision sets LAST-MODIFIED and SEQUENCE from updated_at, and DTSTAMP
+// from the sync that produced the data
+func setRevision(event *ics.VEvent, updatedAt *time.Time, synced TableSyncTime) {
+	event.SetDtStampTime(synced.stamp())
+
+	if updatedAt == nil {
+		return
+	}
+
+	event.SetLastModifiedAt(*updatedAt)
+
+	sequence := int(updatedAt.Sub(sequenceEpoch) / time.Minute)
+	if sequence < 0 {
+		sequence = 0
+	}
+	event.SetSequence(sequence)
+}
+
+// isCancelled reports whether an event has been marked as cancelled in its
+// title, which is how the club records it
+func isCancelled(title string) bool {
+	t := strings.ToLower(title)
+	return strings.Contains(t, "cancelled") || strings.Contains(t, "canceled")
+}
+
+func createCalendarEvent(meet Meet, synced TableSyncTime, member *memberMeet) *ics.VEvent {
 	event := ics.NewEvent(fmt.Sprintf("meet-%d@rockhoppers.org", meet.ID))
 
-	event.SetSummary(meet.Title)
+	summary := meet.Title
+	if member != nil && member.Booking != nil && member.Booking.Status == BookingStatusWaitlisted {
+		summary = fmt.Sprintf("[Waiting list] %s", summary)
+	}
+	event.SetSummary(summary)
+
+	full := meet.SpacesAvailable != nil && *meet.SpacesAvailable == 0
+
+	switch {
+	case isCancelled(meet.Title):
+		event.SetStatus(ics.ObjectStatusCancelled)
+	case member != nil && member.Booking != nil && member.Booking.Status == BookingStatusWaitlisted:
+		// Whether a waitlisted member goes is still undecided
+		event.SetStatus(ics.ObjectStatusTentative)
+	default:
+		event.SetStatus(ics.ObjectStatusConfirmed)
+	}
+
+	event.AddCategory(CategoryMeet)
+	if meet.NonLMC != nil && *meet.NonLMC == 1 {
+		event.AddCategory(CategoryNonLMC)
+	}
+	if full {
+		event.AddCategory(CategoryFull)
+	}
+
+	event.SetURL(meet.WebsiteURL)
+	setRevision(event, meet.UpdatedAt, synced)
+
+	// Only the club address from the public member columns is shared, so the
+	// public feed can carry it too
+	if meet.Steward != nil && meet.Steward.ClubEmail != "" {
+		event.SetOrganizer("mailto:"+meet.Steward.ClubEmail, ics.WithCN(meet.Steward.DisplayName))
+	}
 
 	description := meet.Description
 
-	description = fmt.Sprintf("%s\n\n%s", description, meet.WebsiteURL)
+	if member != nil {
+		if member.Steward {
+			description = fmt.Sprintf("You are steward\n\n%s", description)
+		}
+		if member.Booking != nil {
+			switch member.Booking.Status {
+			case BookingStatusBooked:
+				description = fmt.Sprintf("Your booking: Booked\n\n%s", description)
+			case BookingStatusWaitlisted:
+				description = fmt.Sprintf("Your booking: On the waiting list\n\n%s", description)
+			}
+		}
+	}
 
 	if meet.MeetStewardNotes != "" {
 		description = fmt.Sprintf("%s\n\nSteward Notes: %s", description, meet.MeetStewardNotes)
@@ -23,22 +113,14 @@ func createCalendarEvent(meet Meet, lastSyncTime time.Time) *ics.VEvent {
 	if meet.DateNotes != "" {
 		description = fmt.Sprintf("%s\n\nDate Notes: %s", description, meet.DateNotes)
 	}
-	if meet.SpacesAvailable != nil {
-		if *meet.SpacesAvailable == 0 {
-			description = fmt.Sprintf("%s\n\nMeet Full", description)
-		} else {
-			description = fmt.Sprintf("%s\n\nSpaces Available: %d", description, *meet.SpacesAvailable)
-		}
+	if meet.SpacesAvailable != nil && !full {
+		description = fmt.Sprintf("%s\n\nSpaces Available: %d", description, *meet.SpacesAvailable)
 	}
 	if meet.BookingsOpenDate != nil {
 		description = fmt.Sprintf("%s\n\nBookings are open from %s.", description, meet.BookingsOpenDate.Format("2 January 2006"))
 	}
 
-	description = fmt.Sprintf(
-		"%s\n\nNote: Meet details and availability correct as of last sync: %s",
-		description,
-		lastSyncTime.Format("2 January 2006 15:04:05"),
-	)
+	description = fmt.Sprintf("%s\n\n%s", description, synced.note())
 
 	event.SetDescription(description)
 
@@ -65,33 +147,41 @@ func createCalendarEvent(meet Meet, lastSyncTime time.Time) *ics.VEvent {
 	return event
 }
 
-func createSocialCalendarEvent(social Social, lastSyncTime time.Time) *ics.VEvent {
+func createSocialCalendarEvent(social Social, synced TableSyncTime) *ics.VEvent {
 	event := ics.NewEvent(fmt.Sprintf("social-%d@rockhoppers.org", social.ID))
 
 	event.SetSummary(social.Title)
 
+	if isCancelled(social.Title) {
+		event.SetStatus(ics.ObjectStatusCancelled)
+	} else {
+		event.SetStatus(ics.ObjectStatusConfirmed)
+	}
+	event.AddCategory(CategorySocial)
+	setRevision(event, social.UpdatedAt, synced)
+
 	description := social.Description
 
 	if social.Speaker != "" {
 		description = fmt.Sprintf("%s\n\nSpeaker: %s", description, social.Speaker)
 	}
 
-	description = fmt.Sprintf("%s\n\nLocation: %s", description, social.Location)
+	startAt, timed := socialStartAt(social)
 
-	if social.StartTime != "" {
+	// Only fall back to mentioning the time when it couldn't be parsed
+	if social.StartTime != "" && !timed {
 		description = fmt.Sprintf("%s\n\nTime: %s", description, social.StartTime)
 	}
 
-	description = fmt.Sprintf(
-		"%s\n\nNote: Meet details and availability correct as of last sync: %s",
-		description,
-		lastSyncTime.Format("2 January 2006 15:04:05"),
-	)
+	description = fmt.Sprintf("%s\n\n%s", description, synced.note())
 
 	event.SetDescription(description)
 	event.SetLocation(social.Location)
 
-	if social.StartDate != nil {
+	if timed {
+		setLondonTime(event, ics.ComponentPropertyDtStart, startAt)
+		setLondonTime(event, ics.ComponentPropertyDtEnd, startAt.Add(SocialEventDuration))
+	} else if social.StartDate != nil {
 		// For all-day events, we need to set the date without time component
 		event.SetAllDayStartAt(*social.StartDate)
 
@@ -103,7 +193,161 @@ func createSocialCalendarEvent(social Social, lastSyncTime time.Time) *ics.VEven
 	return event
 }
 
-func GenerateCalendar(db *sql.DB, member_id ...string) (string, error) {
+// DefaultCalendarPastDays is how far back feeds go unless asked otherwise.
+// Older events rarely matter to subscribers and make feeds slow to refresh.
+const DefaultCalendarPastDays = 90
+
+const (
+	CalendarTypeMeets   = "meets"
+	CalendarTypeSocials = "socials"
+)
+
+// CalendarOptions controls what goes into a generated calendar
+type CalendarOptions struct {
+	// MemberID personalises the feed to one member's meets when set
+	MemberID string
+	// From and To bound the events included. Nil means unbounded.
+	From *time.Time
+	To   *time.Time
+	// Meets and Socials select which event types are included
+	Meets   bool
+	Socials bool
+	// BookingReminderEvents adds a "Bookings open" event on the day bookings
+	// open for each meet, and BookingReminderAlarms adds an alarm to the meet
+	// itself that fires then
+	BookingReminderEvents bool
+	BookingReminderAlarms bool
+	// MeetsSynced and SocialsSynced are how current the tables are, noted in
+	// each event. Nil means look them up when generating.
+	MeetsSynced   *TableSyncTime
+	SocialsSynced *TableSyncTime
+}
+
+// LoadSyncTimes looks up whichever of the sync times aren't already set, so
+// callers that need them before generating only query them once
+func (opts *CalendarOptions) LoadSyncTimes(db *sql.DB) {
+	if opts.MeetsSynced == nil {
+		synced := GetTableSyncTime(db, "meets")
+		opts.MeetsSynced = &synced
+	}
+	if opts.SocialsSynced == nil {
+		synced := GetTableSyncTime(db, "socials")
+		opts.SocialsSynced = &synced
+	}
+}
+
+// SetBookingReminders turns on the reminder kinds listed
+func (opts *CalendarOptions) SetBookingReminders(reminders []string) {
+	opts.BookingReminderEvents, opts.BookingReminderAlarms = false, false
+	for _, r := range reminders {
+		switch r {
+		case BookingReminderEvent:
+			opts.BookingReminderEvents = true
+		case BookingReminderAlarm:
+			opts.BookingReminderAlarms = true
+		}
+	}
+}
+
+// DefaultCalendarOptions covers the last DefaultCalendarPastDays days and
+// everything in the future, for both meets and socials
+func DefaultCalendarOptions() CalendarOptions {
+	from := time.Now().AddDate(0, 0, -DefaultCalendarPastDays)
+	return CalendarOptions{From: &from, Meets: true, Socials: true}
+}
+
+// ParseCalendarOptions reads calendar options from query parameters: from and
+// to dates, past_days as an alternative to from (0 for no limit) and types as
+// a comma separated list of meets and socials, and reminders as a comma
+// separated list of event and alarm
+func ParseCalendarOptions(values url.Values) (CalendarOptions, error) {
+	opts := DefaultCalendarOptions()
+
+	if v := values.Get("past_days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			return opts, invalidQuery("past_days must be a non-negative integer")
+		}
+		if days == 0 {
+			opts.From = nil
+		} else {
+			from := time.Now().AddDate(0, 0, -days)
+			opts.From = &from
+		}
+	}
+
+	from, err := parseQueryDate(values, "from")
+	if err != nil {
+		return opts, err
+	}
+	if from != nil {
+		opts.From = from
+	}
+
+	if opts.To, err = parseQueryDate(values, "to"); err != nil {
+		return opts, err
+	}
+
+	if opts.From != nil && opts.To != nil && opts.To.Before(*opts.From) {
+		return opts, invalidQuery("to must not be before from")
+	}
+
+	if v := values.Get("types"); v != "" {
+		opts.Meets, opts.Socials = false, false
+		for _, t := range strings.Split(v, ",") {
+			switch strings.TrimSpace(t) {
+			case CalendarTypeMeets:
+				opts.Meets = true
+			case CalendarTypeSocials:
+				opts.Socials = true
+			default:
+				return opts, invalidQuery("unknown calendar type %q", t)
+			}
+		}
+	}
+
+	if values.Has("reminders") {
+		reminders, err := ParseBookingReminders(values.Get("reminders"))
+		if err != nil {
+			return opts, err
+		}
+		opts.SetBookingReminders(reminders)
+	}
+
+	return opts, nil
+}
+
+// GenerateCalendar builds the club calendar. When a member id is given the
+// feed only contains the meets that member is booked on, waitlisted for or
+// stewarding, alongside all socials.
+func GenerateCalendar(db *sql.DB, opts CalendarOptions) (string, error) {
+	opts.LoadSyncTimes(db)
+
+	memberID := opts.MemberID
+	var bookings map[int64]Booking
+	var stewardID int64
+
+	if memberID != "" {
+		var err error
+		stewardID, err = strconv.ParseInt(memberID, 10, 64)
+		if err != nil {
+			return "", ErrMemberNotFound
+		}
+
+		exists, err := MemberExists(db, memberID)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", ErrMemberNotFound
+		}
+
+		bookings, err = GetActiveBookingsForMember(db, memberID)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	cal := ics.NewCalendar()
 	cal.SetMethod(ics.MethodPublish)
 	cal.SetProductId("-//Rockhoppers//Events Calendar//EN")
@@ -111,38 +355,133 @@ func GenerateCalendar(db *sql.DB, member_id ...string) (string, error) {
 	cal.SetDescription("Calendar of all Rockhoppers events")
 	cal.SetXWRCalName("Rockhoppers meets & socials")
 	cal.SetXWRCalDesc("Calendar of all Rockhoppers events")
+	cal.AddVTimezone(newLondonTimezone())
 
-	meets, err := GetAllMeets(db)
-	if err != nil {
-		return "", err
+	if memberID != "" {
+		cal.SetName("My Rockhoppers meets & socials")
+		cal.SetDescription("Rockhoppers meets you are booked on or stewarding, plus all socials")
+		cal.SetXWRCalName("My Rockhoppers meets & socials")
+		cal.SetXWRCalDesc("Rockhoppers meets you are booked on or stewarding, plus all socials")
 	}
 
-	var meetsLastSyncTime time.Time
-	err = db.QueryRow("SELECT last_sync_time FROM sync_metadata WHERE table_name = 'meets'").Scan(&meetsLastSyncTime)
+	window := ListQuery{From: opts.From, To: opts.To}
+
+	if opts.Meets {
+		if err := addMeetEvents(db, cal, opts, window, stewardID, bookings); err != nil {
+			return "", err
+		}
+	}
+
+	if opts.Socials {
+		if err := addSocialEvents(db, cal, window, *opts.SocialsSynced); err != nil {
+			return "", err
+		}
+	}
+
+	return cal.Serialize(), nil
+}
+
+func addMeetEvents(db *sql.DB, cal *ics.Calendar, opts CalendarOptions, window ListQuery, stewardID int64, bookings map[int64]Booking) error {
+	memberID := opts.MemberID
+
+	meets, err := FindMeets(db, window)
 	if err != nil {
-		meetsLastSyncTime = time.Now() // Default to current time if no sync time available
+		return err
+	}
+
+	meetsSynced := *opts.MeetsSynced
+
+	ptrs := make([]*Meet, len(meets))
+	for i := range meets {
+		ptrs[i] = &meets[i]
+	}
+	if err := ExpandMeetStewards(db, ptrs...); err != nil {
+		return err
 	}
 
+	now := time.Now()
+
 	for _, meet := range meets {
-		event := createCalendarEvent(meet, meetsLastSyncTime)
+		if memberID == "" {
+			event := createCalendarEvent(meet, meetsSynced, nil)
+			addBookingReminders(cal, event, meet, opts, now)
+			cal.AddVEvent(event)
+			continue
+		}
+
+		member := &memberMeet{
+			Steward: meet.MeetStewardID != nil && *meet.MeetStewardID == stewardID,
+		}
+		if booking, ok := bookings[meet.ID]; ok {
+			member.Booking = &booking
+		}
+		if member.Booking == nil && !member.Steward {
+			// Members may still want to know when they can book meets
+			// they aren't on yet
+			if opts.BookingReminderEvents {
+				addBookingReminders(cal, nil, meet, opts, now)
+			}
+			continue
+		}
+
+		event := createCalendarEvent(meet, meetsSynced, member)
+		if member.Booking == nil {
+			addBookingReminders(cal, event, meet, opts, now)
+		}
 		cal.AddVEvent(event)
 	}
 
-	socials, err := GetAllSocials(db)
-	if err != nil {
-		return "", err
+	return nil
+}
+
+// bookingsOpenHour is when on the bookings open date alarms fire, London time
+const bookingsOpenHour = 9
+
+// addBookingReminders adds whichever bookings open reminders the options ask
+// for. Meets whose bookings have already opened get none. event may be nil
+// when only a separate reminder event is wanted.
+func addBookingReminders(cal *ics.Calendar, event *ics.VEvent, meet Meet, opts CalendarOptions, now time.Time) {
+	if meet.BookingsOpenDate == nil || isCancelled(meet.Title) {
+		return
+	}
+
+	d := *meet.BookingsOpenDate
+	opensAt := time.Date(d.Year(), d.Month(), d.Day(), bookingsOpenHour, 0, 0, 0, londonLocation)
+	if opensAt.Before(now) {
+		return
 	}
 
-	var socialsLastSyncTime time.Time
-	err = db.QueryRow("SELECT last_sync_time FROM sync_metadata WHERE table_name = 'socials'").Scan(&socialsLastSyncTime)
+	if opts.BookingReminderEvents {
+		reminder := ics.NewEvent(fmt.Sprintf("meet-%d-bookings-open@rockhoppers.org", meet.ID))
+		reminder.SetSummary(fmt.Sprintf("Bookings open: %s", meet.Title))
+		reminder.SetDescription(fmt.Sprintf("Bookings open today for %s.\n\n%s", meet.Title, meet.WebsiteURL))
+		reminder.SetURL(meet.WebsiteURL)
+		reminder.AddCategory(CategoryMeet)
+		reminder.SetDtStampTime(now)
+		reminder.SetAllDayStartAt(d)
+		reminder.SetAllDayEndAt(d.AddDate(0, 0, 1))
+		reminder.SetTimeTransparency(ics.TransparencyTransparent)
+		cal.AddVEvent(reminder)
+	}
+
+	if opts.BookingReminderAlarms && event != nil {
+		alarm := event.AddAlarm()
+		alarm.SetAction(ics.ActionDisplay)
+		alarm.SetTrigger(opensAt.UTC().Format("20060102T150405Z"), ics.WithValue(string(ics.ValueDataTypeDateTime)))
+		alarm.SetProperty(ics.ComponentPropertyDescription, fmt.Sprintf("Bookings open today for %s", meet.Title))
+	}
+}
+
+func addSocialEvents(db *sql.DB, cal *ics.Calendar, window ListQuery, socialsSynced TableSyncTime) error {
+	socials, err := FindSocials(db, window)
 	if err != nil {
-		socialsLastSyncTime = time.Now() // Default to current time if no sync time available
+		return err
 	}
 
 	for _, social := range socials {
-		event := createSocialCalendarEvent(social, socialsLastSyncTime)
+		event := createSocialCalendarEvent(social, socialsSynced)
 		cal.AddVEvent(event)
 	}
 
-	return cal.Serialize(), nil
+	return nil
 }
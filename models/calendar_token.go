@@ -0,0 +1,192 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrFeedTokenNotFound = errors.New("calendar feed token not found")
+
+// CalendarFeedToken is the secret embedded in a member's calendar subscription
+// URL. It is deliberately separate from the member's API key so a leaked
+// calendar URL can be revoked without breaking API access and vice versa.
+type CalendarFeedToken struct {
+	MemberID  int64     `json:"member_id"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func EnsureCalendarFeedTokensTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS calendar_feed_tokens (
+			member_id INTEGER PRIMARY KEY,
+			token TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create calendar_feed_tokens table: %v", err)
+	}
+	return nil
+}
+
+func generateFeedToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GetMemberIDForFeedToken resolves a subscription token to the member it belongs to
+func GetMemberIDForFeedToken(db *sql.DB, token string) (int64, error) {
+	var memberID int64
+	err := db.QueryRow("SELECT member_id FROM calendar_feed_tokens WHERE token = ?", token).Scan(&memberID)
+	if err == sql.ErrNoRows {
+		return 0, ErrFeedTokenNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return memberID, nil
+}
+
+// GetOrCreateFeedToken returns the member's current feed token, issuing one if
+// they have never had one
+func GetOrCreateFeedToken(db *sql.DB, memberID int64) (*CalendarFeedToken, error) {
+	t, err := getFeedToken(db, memberID)
+	if err != sql.ErrNoRows {
+		return t, err
+	}
+	return RotateFeedToken(db, memberID)
+}
+
+// RotateFeedToken issues a new feed token for the member, invalidating any
+// existing subscription URL
+func RotateFeedToken(db *sql.DB, memberID int64) (*CalendarFeedToken, error) {
+	token, err := generateFeedToken()
+	if err != nil {
+		return nil, fmt.Errorf("error generating feed token: %v", err)
+	}
+
+	_, err = db.Exec(
+		"INSERT OR REPLACE INTO calendar_feed_tokens (member_id, token, created_at) VALUES (?, ?, ?)",
+		memberID,
+		token,
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return getFeedToken(db, memberID)
+}
+
+// RevokeFeedToken removes the member's feed token so their subscription URL
+// stops working until a new one is requested
+func RevokeFeedToken(db *sql.DB, memberID int64) error {
+	_, err := db.Exec("DELETE FROM calendar_feed_tokens WHERE member_id = ?", memberID)
+	return err
+}
+
+func getFeedToken(db *sql.DB, memberID int64) (*CalendarFeedToken, error) {
+	var t CalendarFeedToken
+	var createdAt sql.NullString
+
+	err := db.QueryRow(
+		"SELECT member_id, token, created_at FROM calendar_feed_tokens WHERE member_id = ?",
+		memberID,
+	).Scan(&t.MemberID, &t.Token, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed := parseDate(createdAt, "created_at"); parsed != nil {
+		t.CreatedAt = *parsed
+	}
+
+	return &t, nil
+}
+
+const (
+	BookingReminderEvent = "event"
+	BookingReminderAlarm = "alarm"
+)
+
+// CalendarPreferences are a member's defaults for their personal feed, used
+// when the subscription URL doesn't say otherwise
+type CalendarPreferences struct {
+	BookingReminders []string `json:"booking_reminders"`
+}
+
+func EnsureCalendarPreferencesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS calendar_preferences (
+			member_id INTEGER PRIMARY KEY,
+			booking_reminders TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create calendar_preferences table: %v", err)
+	}
+	return nil
+}
+
+// ParseBookingReminders validates a comma separated list of reminder kinds.
+// "none" or an empty string turns reminders off.
+func ParseBookingReminders(value string) ([]string, error) {
+	reminders := []string{}
+	for _, r := range strings.Split(value, ",") {
+		switch r = strings.TrimSpace(r); r {
+		case "", "none":
+		case BookingReminderEvent, BookingReminderAlarm:
+			reminders = append(reminders, r)
+		default:
+			return nil, invalidQuery("unknown booking reminder %q", r)
+		}
+	}
+	return reminders, nil
+}
+
+func GetCalendarPreferences(db *sql.DB, memberID int64) (*CalendarPreferences, error) {
+	var reminders string
+	err := db.QueryRow("SELECT booking_reminders FROM calendar_preferences WHERE member_id = ?", memberID).Scan(&reminders)
+	if err == sql.ErrNoRows {
+		return &CalendarPreferences{BookingReminders: []string{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := ParseBookingReminders(reminders)
+	if err != nil {
+		return nil, err
+	}
+	return &CalendarPreferences{BookingReminders: parsed}, nil
+}
+
+func SaveCalendarPreferences(db *sql.DB, memberID int64, prefs CalendarPreferences) error {
+	reminders, err := ParseBookingReminders(strings.Join(prefs.BookingReminders, ","))
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO calendar_preferences (member_id, booking_reminders, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT (member_id) DO UPDATE SET
+			booking_reminders = excluded.booking_reminders,
+			updated_at = excluded.updated_at
+	`,
+		memberID,
+		strings.Join(reminders, ","),
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	return err
+}
@@ -0,0 +1,215 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The sync copies whatever columns MySQL has and appends new ones to the end
+// of the SQLite table, so models never rely on the physical column order.
+// Struct fields are mapped to columns with `db` tags and the select list is
+// built from the columns the table actually has, as reported by PRAGMA
+// table_info. Columns the table doesn't have are left at their zero value and
+// columns the struct doesn't know about are ignored.
+
+type fieldColumn struct {
+	column string
+	index  int
+	typ    reflect.Type
+}
+
+var (
+	timePtrType  = reflect.TypeOf((*time.Time)(nil))
+	intPtrType   = reflect.TypeOf((*int)(nil))
+	int64PtrType = reflect.TypeOf((*int64)(nil))
+)
+
+// structColumns returns the db tagged fields of a struct type
+func structColumns(t reflect.Type) []fieldColumn {
+	var fields []fieldColumn
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		column := f.Tag.Get("db")
+		if column == "" || column == "-" {
+			continue
+		}
+		fields = append(fields, fieldColumn{column: column, index: i, typ: f.Type})
+	}
+	return fields
+}
+
+type cachedTableColumns struct {
+	db      *sql.DB
+	columns map[string]bool
+}
+
+var (
+	tableColumnsMu    sync.Mutex
+	tableColumnsCache = make(map[string]cachedTableColumns)
+)
+
+// tableColumns returns the set of columns in a table. Results are cached until
+// the database is reopened, which is the only time the schema can change.
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	tableColumnsMu.Lock()
+	cached, ok := tableColumnsCache[table]
+	tableColumnsMu.Unlock()
+	if ok && cached.db == db {
+		return cached.columns, nil
+	}
+
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[strings.ToLower(name)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s does not exist", table)
+	}
+
+	tableColumnsMu.Lock()
+	tableColumnsCache[table] = cachedTableColumns{db: db, columns: columns}
+	tableColumnsMu.Unlock()
+
+	return columns, nil
+}
+
+// columnSet is the resolved mapping between a struct and a table
+type columnSet struct {
+	table   string
+	fields  []fieldColumn
+	present map[string]bool
+}
+
+func resolveColumns(db *sql.DB, table string, model interface{}) (*columnSet, error) {
+	present, err := tableColumns(db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []fieldColumn
+	for _, f := range structColumns(reflect.TypeOf(model)) {
+		if present[strings.ToLower(f.column)] {
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("table %s has none of the expected columns", table)
+	}
+
+	return &columnSet{table: table, fields: fields, present: present}, nil
+}
+
+// restrict narrows the set to the allowed columns
+func (cs *columnSet) restrict(allowed []string) *columnSet {
+	allow := make(map[string]bool)
+	for _, c := range allowed {
+		allow[strings.ToLower(strings.TrimSpace(c))] = true
+	}
+
+	restricted := &columnSet{table: cs.table, present: make(map[string]bool)}
+	for _, f := range cs.fields {
+		if allow[strings.ToLower(f.column)] {
+			restricted.fields = append(restricted.fields, f)
+		}
+	}
+	for c := range cs.present {
+		if allow[c] {
+			restricted.present[c] = true
+		}
+	}
+
+	return restricted
+}
+
+// has reports whether the table has a column
+func (cs *columnSet) has(column string) bool {
+	return cs.present[strings.ToLower(column)]
+}
+
+// selectList returns the quoted column list for a SELECT
+func (cs *columnSet) selectList() string {
+	names := make([]string, len(cs.fields))
+	for i, f := range cs.fields {
+		names[i] = fmt.Sprintf(`"%s"`, f.column)
+	}
+	return strings.Join(names, ", ")
+}
+
+// scan reads a row selected with selectList into dest, a pointer to the
+// struct the columnSet was resolved for. NULLs become zero values or nil
+// pointers and dates are parsed with parseDate.
+func (cs *columnSet) scan(scanner interface {
+	Scan(dest ...interface{}) error
+}, dest interface{}) error {
+	targets := make([]interface{}, len(cs.fields))
+	for i, f := range cs.fields {
+		switch f.typ.Kind() {
+		case reflect.Int, reflect.Int64, reflect.Bool:
+			targets[i] = &sql.NullInt64{}
+		case reflect.Float64:
+			targets[i] = &sql.NullFloat64{}
+		default:
+			if f.typ == intPtrType || f.typ == int64PtrType {
+				targets[i] = &sql.NullInt64{}
+			} else {
+				targets[i] = &sql.NullString{}
+			}
+		}
+	}
+
+	if err := scanner.Scan(targets...); err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(dest).Elem()
+	for i, f := range cs.fields {
+		field := v.Field(f.index)
+
+		switch t := targets[i].(type) {
+		case *sql.NullInt64:
+			switch {
+			case f.typ == intPtrType:
+				field.Set(reflect.ValueOf(nullIntToPtr(*t)))
+			case f.typ == int64PtrType:
+				if t.Valid {
+					n := t.Int64
+					field.Set(reflect.ValueOf(&n))
+				}
+			case f.typ.Kind() == reflect.Bool:
+				field.SetBool(t.Valid && t.Int64 != 0)
+			default:
+				field.SetInt(t.Int64)
+			}
+		case *sql.NullFloat64:
+			field.SetFloat(t.Float64)
+		case *sql.NullString:
+			switch {
+			case f.typ == timePtrType:
+				field.Set(reflect.ValueOf(parseDate(*t, f.column)))
+			case f.typ.Kind() == reflect.String:
+				field.SetString(t.String)
+			default:
+				return fmt.Errorf("unsupported field type %s for column %s", f.typ, f.column)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SnapshotCloseDelay is how long a replaced snapshot stays open for requests
+// that were already using it
+var SnapshotCloseDelay = time.Minute
+
+// Database holds the connection to the synced SQLite file. The sync replaces
+// that file wholesale by renaming a new snapshot over it, so Database watches
+// for a new file at the path and reopens its *sql.DB when one appears.
+type Database struct {
+	path string
+	init func(*sql.DB) error
+
+	mu         sync.RWMutex
+	db         *sql.DB
+	file       os.FileInfo
+	generation int64
+}
+
+// OpenDatabase opens the SQLite file at path. init is run against every
+// connection pool opened, including after a snapshot swap.
+func OpenDatabase(path string, init func(*sql.DB) error) (*Database, error) {
+	d := &Database{path: path, init: init}
+	if _, err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DB returns the connection pool for the current snapshot
+func (d *Database) DB() *sql.DB {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.db
+}
+
+// Generation returns the snapshot generation recorded by the sync
+func (d *Database) Generation() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.generation
+}
+
+// Reload reopens the database if the file at the path has been replaced since
+// it was last opened, and reports whether it did
+func (d *Database) Reload() (bool, error) {
+	info, err := os.Stat(d.path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	d.mu.RLock()
+	unchanged := d.db != nil && info != nil && d.file != nil && os.SameFile(info, d.file)
+	d.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	db, err := sql.Open("sqlite3", d.path)
+	if err != nil {
+		return false, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return false, err
+	}
+
+	if d.init != nil {
+		if err := d.init(db); err != nil {
+			log.Println("Failed to initialise database:", err)
+		}
+	}
+
+	var generation int64
+	if err := db.QueryRow("PRAGMA user_version").Scan(&generation); err != nil {
+		log.Println("Failed to read snapshot generation:", err)
+	}
+
+	// The file may not have existed until sql.Open created it
+	if info == nil {
+		info, _ = os.Stat(d.path)
+	}
+
+	d.mu.Lock()
+	old := d.db
+	d.db = db
+	d.file = info
+	d.generation = generation
+	d.mu.Unlock()
+
+	if old != nil {
+		log.Printf("Reopened database at %s (snapshot generation %d)", d.path, generation)
+		// Handlers may still be partway through a run of queries against the
+		// old pool, and Close would fail any they haven't started yet, so
+		// give them time to finish first
+		time.AfterFunc(SnapshotCloseDelay, func() { old.Close() })
+	}
+
+	return true, nil
+}
+
+// Watch checks for a new snapshot every interval until stop is closed
+func (d *Database) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := d.Reload(); err != nil {
+				log.Println("Failed to reload database:", err)
+			}
+		}
+	}
+}
+
+func (d *Database) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.db == nil {
+		return nil
+	}
+	return d.db.Close()
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReadinessTables are the synced tables the API can't serve without. Each
+// must be present and have synced successfully within its threshold.
+var ReadinessTables = []string{"meets", "socials", "members", "bookings"}
+
+// Readiness is the machine readable result of the readiness checks
+type Readiness struct {
+	Ready    bool             `json:"ready"`
+	Database string           `json:"database"`
+	Tables   []TableReadiness `json:"tables"`
+}
+
+type TableReadiness struct {
+	Table       string     `json:"table"`
+	Ready       bool       `json:"ready"`
+	Present     bool       `json:"present"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	MaxAge      string     `json:"max_age"`
+	Problem     string     `json:"problem,omitempty"`
+}
+
+// ParseSyncThresholds reads per-table maximum sync ages from a comma separated
+// list of table=duration pairs, e.g. "meets=2h,members=48h"
+func ParseSyncThresholds(value string) (map[string]time.Duration, error) {
+	thresholds := make(map[string]time.Duration)
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		table, age, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed threshold %q", pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(age))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid threshold for %s: %q", table, age)
+		}
+		thresholds[strings.TrimSpace(table)] = d
+	}
+
+	return thresholds, nil
+}
+
+// CheckReadiness reports whether the database can be queried, the required
+// tables exist and each has synced recently enough. Tables without their own
+// threshold use SyncStaleAfter.
+func CheckReadiness(db *sql.DB, thresholds map[string]time.Duration) Readiness {
+	r := Readiness{Ready: true, Database: "ok", Tables: []TableReadiness{}}
+
+	if err := db.Ping(); err != nil {
+		r.Ready = false
+		r.Database = err.Error()
+		return r
+	}
+
+	lastSuccess := make(map[string]*time.Time)
+	metadata, err := GetAllSyncMetadata(db)
+	if err != nil {
+		r.Ready = false
+		r.Database = fmt.Sprintf("error reading sync metadata: %v", err)
+		return r
+	}
+	for _, m := range metadata {
+		lastSuccess[m.TableName] = m.LastSyncTime
+	}
+
+	now := time.Now()
+	for _, table := range ReadinessTables {
+		maxAge, ok := thresholds[table]
+		if !ok {
+			maxAge = SyncStaleAfter
+		}
+
+		t := TableReadiness{Table: table, MaxAge: maxAge.String(), LastSuccess: lastSuccess[table]}
+
+		var count int
+		err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name=?", table).Scan(&count)
+		t.Present = err == nil && count > 0
+
+		switch {
+		case err != nil:
+			t.Problem = err.Error()
+		case !t.Present:
+			t.Problem = "table missing"
+		case t.LastSuccess == nil:
+			t.Problem = "never synced successfully"
+		case now.Sub(*t.LastSuccess) > maxAge:
+			t.Problem = fmt.Sprintf("last successful sync %s ago", now.Sub(*t.LastSuccess).Round(time.Second))
+		default:
+			t.Ready = true
+		}
+
+		r.Ready = r.Ready && t.Ready
+		r.Tables = append(r.Tables, t)
+	}
+
+	return r
+}
@@ -0,0 +1,346 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// KeyTables are kept in the keys database rather than the synced one, so
+// rebuilding the synced file from scratch doesn't invalidate every member's
+// API key and calendar subscription
+var KeyTables = []string{"api_keys", "calendar_feed_tokens", "calendar_preferences"}
+
+// KeysImportedVersion is the keys database's user_version once any keys in
+// the synced database have been imported
+const KeysImportedVersion = 1
+
+// DefaultKeysPath is where the keys database lives when KEYS_DB_PATH isn't
+// set, next to the synced database
+func DefaultKeysPath(dataPath string) string {
+	return filepath.Join(filepath.Dir(dataPath), "keys.db")
+}
+
+// OpenKeysDatabase opens the keys database at path, creating its tables. If
+// it is empty and the synced database at legacyPath still holds keys from
+// before they were moved out, those are imported first.
+func OpenKeysDatabase(path, legacyPath string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := ensureKeyTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if legacyPath != "" && legacyPath != path {
+		if err := importLegacyKeys(db, legacyPath); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error importing keys from %s: %v", legacyPath, err)
+		}
+	}
+
+	return db, nil
+}
+
+func ensureKeyTables(db *sql.DB) error {
+	if err := EnsureAPIKeysTable(db); err != nil {
+		return err
+	}
+	if err := EnsureAPIKeyUsageTable(db); err != nil {
+		return err
+	}
+	if err := EnsureCalendarFeedTokensTable(db); err != nil {
+		return err
+	}
+	return EnsureCalendarPreferencesTable(db)
+}
+
+func keysDatabaseEmpty(db *sql.DB) (bool, error) {
+	for _, table := range KeyTables {
+		var count int
+		if err := db.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", table)).Scan(&count); err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// importLegacyKeys copies keys from the synced database into an empty keys
+// database. It only ever runs once per keys database, recorded in its
+// user_version, so stale copies left in the synced file can't come back later.
+func importLegacyKeys(db *sql.DB, legacyPath string) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version >= KeysImportedVersion {
+		return nil
+	}
+
+	if err := copyLegacyKeys(db, legacyPath); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", KeysImportedVersion))
+	return err
+}
+
+// copyLegacyKeys copies whatever key tables the synced database has into the
+// keys database. The synced file belongs to the sync, so it is attached
+// read-only and old layouts are converted while copying rather than migrated
+// in place: plaintext keys are hashed and columns added since are left at
+// their defaults.
+func copyLegacyKeys(db *sql.DB, legacyPath string) error {
+	empty, err := keysDatabaseEmpty(db)
+	if err != nil || !empty {
+		return err
+	}
+	if _, err := os.Stat(legacyPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	// ATTACH is per connection, so everything has to run on the same one
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS legacy", "file:"+legacyPath+"?mode=ro"); err != nil {
+		return fmt.Errorf("error attaching synced database: %v", err)
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE legacy")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	imported := 0
+	for _, table := range KeyTables {
+		columns, plaintext, err := legacyKeyColumns(tx, table)
+		if err != nil {
+			return err
+		}
+
+		if plaintext {
+			keys, err := readPlaintextAPIKeys(tx, "legacy."+table)
+			if err != nil {
+				return fmt.Errorf("error reading plaintext %s: %v", table, err)
+			}
+			if err := insertHashedAPIKeys(tx, keys); err != nil {
+				return fmt.Errorf("error copying %s: %v", table, err)
+			}
+			imported += len(keys)
+			continue
+		}
+		if len(columns) == 0 {
+			continue
+		}
+
+		cols := strings.Join(columns, ", ")
+		res, err := tx.Exec(fmt.Sprintf("INSERT INTO main.%s (%s) SELECT %s FROM legacy.%s", table, cols, cols, table))
+		if err != nil {
+			return fmt.Errorf("error copying %s: %v", table, err)
+		}
+		n, _ := res.RowsAffected()
+		imported += int(n)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if imported > 0 {
+		log.Printf("Imported %d rows of keys and calendar settings from %s", imported, legacyPath)
+	}
+	return nil
+}
+
+// legacyKeyColumns returns the columns a key table in the attached synced
+// database shares with the keys database, none if it doesn't have the table,
+// and whether it is api_keys from before keys were hashed
+func legacyKeyColumns(tx *sql.Tx, table string) ([]string, bool, error) {
+	rows, err := tx.Query(`
+		SELECT l.name, m.name IS NOT NULL
+		FROM pragma_table_info(?, 'legacy') l
+		LEFT JOIN pragma_table_info(?, 'main') m ON m.name = l.name
+	`, table, table)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	plaintext := false
+	for rows.Next() {
+		var name string
+		var shared bool
+		if err := rows.Scan(&name, &shared); err != nil {
+			return nil, false, err
+		}
+		if shared {
+			columns = append(columns, name)
+		}
+		if table == "api_keys" && name == "api_key" {
+			plaintext = true
+		}
+	}
+	return columns, plaintext, rows.Err()
+}
+
+// KeysBackup is everything in the keys database, as written by ExportKeys
+type KeysBackup struct {
+	ExportedAt          time.Time                  `json:"exported_at"`
+	APIKeys             []ExportedAPIKey           `json:"api_keys"`
+	FeedTokens          []CalendarFeedToken        `json:"calendar_feed_tokens"`
+	CalendarPreferences []StoredCalendarPreference `json:"calendar_preferences"`
+}
+
+// StoredCalendarPreference is one member's row in calendar_preferences
+type StoredCalendarPreference struct {
+	MemberID         int64    `json:"member_id"`
+	BookingReminders []string `json:"booking_reminders"`
+}
+
+// ExportKeys returns the contents of the keys database. Like ExportAPIKeys,
+// the result includes key hashes and feed tokens, so treat it as a secret.
+func ExportKeys(db *sql.DB) (*KeysBackup, error) {
+	keys, err := ExportAPIKeys(db)
+	if err != nil {
+		return nil, err
+	}
+
+	backup := &KeysBackup{
+		ExportedAt:          time.Now().UTC().Truncate(time.Second),
+		APIKeys:             keys,
+		FeedTokens:          []CalendarFeedToken{},
+		CalendarPreferences: []StoredCalendarPreference{},
+	}
+
+	rows, err := db.Query("SELECT member_id, token, created_at FROM calendar_feed_tokens ORDER BY member_id")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var t CalendarFeedToken
+		var createdAt sql.NullString
+		if err := rows.Scan(&t.MemberID, &t.Token, &createdAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if parsed := parseDate(createdAt, "created_at"); parsed != nil {
+			t.CreatedAt = *parsed
+		}
+		backup.FeedTokens = append(backup.FeedTokens, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT member_id, booking_reminders FROM calendar_preferences ORDER BY member_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p StoredCalendarPreference
+		var reminders string
+		if err := rows.Scan(&p.MemberID, &reminders); err != nil {
+			return nil, err
+		}
+		if p.BookingReminders, err = ParseBookingReminders(reminders); err != nil {
+			return nil, err
+		}
+		backup.CalendarPreferences = append(backup.CalendarPreferences, p)
+	}
+
+	return backup, rows.Err()
+}
+
+// ImportKeys loads a backup into the keys database, replacing any keys,
+// tokens and preferences with the same IDs and leaving the rest alone
+func ImportKeys(db *sql.DB, backup *KeysBackup) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, k := range backup.APIKeys {
+		if k.KeyHash == "" || k.Salt == "" {
+			return invalidQuery("API key %d has no hash or salt", k.ID)
+		}
+
+		_, err := tx.Exec(`
+			INSERT OR REPLACE INTO api_keys
+				(id, member_id, key_prefix, key_hash, salt, scopes, label, created_at, expires_at, revoked_at, last_used_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+			k.ID,
+			k.MemberID,
+			k.Prefix,
+			k.KeyHash,
+			k.Salt,
+			strings.Join(k.Scopes, " "),
+			k.Label,
+			k.CreatedAt.UTC().Format(time.RFC3339),
+			formatKeyTime(k.ExpiresAt),
+			formatKeyTime(k.RevokedAt),
+			formatKeyTime(k.LastUsedAt),
+		)
+		if err != nil {
+			return fmt.Errorf("error importing API key %d: %v", k.ID, err)
+		}
+	}
+
+	for _, t := range backup.FeedTokens {
+		_, err := tx.Exec(
+			"INSERT OR REPLACE INTO calendar_feed_tokens (member_id, token, created_at) VALUES (?, ?, ?)",
+			t.MemberID,
+			t.Token,
+			t.CreatedAt.UTC().Format(time.RFC3339),
+		)
+		if err != nil {
+			return fmt.Errorf("error importing calendar feed token for member %d: %v", t.MemberID, err)
+		}
+	}
+
+	for _, p := range backup.CalendarPreferences {
+		reminders, err := ParseBookingReminders(strings.Join(p.BookingReminders, ","))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"INSERT OR REPLACE INTO calendar_preferences (member_id, booking_reminders, updated_at) VALUES (?, ?, ?)",
+			p.MemberID,
+			strings.Join(reminders, ","),
+			time.Now().UTC().Format(time.RFC3339),
+		)
+		if err != nil {
+			return fmt.Errorf("error importing calendar preferences for member %d: %v", p.MemberID, err)
+		}
+	}
+
+	return tx.Commit()
+}
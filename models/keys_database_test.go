@@ -0,0 +1,153 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// legacyKeysSQL is a synced database from before the keys database, with
+// plaintext API keys and calendar settings kept alongside the synced tables
+const legacyKeysSQL = `
+	CREATE TABLE members (id INTEGER PRIMARY KEY, first_name TEXT);
+	INSERT INTO members (id, first_name) VALUES (7, 'Alice'), (8, 'Bob');
+
+	CREATE TABLE api_keys (member_id INTEGER PRIMARY KEY, api_key TEXT NOT NULL, created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP);
+	INSERT INTO api_keys (member_id, api_key, created_at) VALUES
+		(7, '11111111-2222-3333-4444-555555555555', '2024-01-01 10:00:00'),
+		(8, '66666666-7777-8888-9999-000000000000', '2024-02-01 10:00:00');
+
+	CREATE TABLE calendar_feed_tokens (member_id INTEGER PRIMARY KEY, token TEXT NOT NULL UNIQUE, created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP);
+	INSERT INTO calendar_feed_tokens (member_id, token) VALUES (7, 'feedtoken7');
+`
+
+func writeLegacyDatabase(t *testing.T, path string) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(legacyKeysSQL); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenKeysDatabaseImportsLegacyKeys(t *testing.T) {
+	dir := t.TempDir()
+	legacyPath := filepath.Join(dir, "rockhoppers.db")
+	keysPath := DefaultKeysPath(legacyPath)
+	writeLegacyDatabase(t, legacyPath)
+
+	before, err := os.ReadFile(legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keysDB, err := OpenKeysDatabase(keysPath, legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keysDB.Close()
+
+	// The synced file belongs to the sync and is only ever read
+	after, err := os.ReadFile(legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("importing keys changed the synced database")
+	}
+
+	// Plaintext keys keep working, but only their hashes are stored
+	for member, key := range map[int64]string{
+		7: "11111111-2222-3333-4444-555555555555",
+		8: "66666666-7777-8888-9999-000000000000",
+	} {
+		got, err := AuthenticateAPIKey(keysDB, key)
+		if err != nil {
+			t.Errorf("member %d's legacy key: %v", member, err)
+			continue
+		}
+		if got.MemberID != member || len(got.Scopes) != len(DefaultScopes) {
+			t.Errorf("member %d's legacy key imported as %+v, want theirs with the default scopes", member, got)
+		}
+	}
+	var stored int
+	if err := keysDB.QueryRow(
+		"SELECT count(*) FROM api_keys WHERE key_hash IN (?, ?)",
+		"11111111-2222-3333-4444-555555555555", "66666666-7777-8888-9999-000000000000",
+	).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 0 {
+		t.Error("legacy keys were stored in plaintext")
+	}
+
+	if member, err := GetMemberIDForFeedToken(keysDB, "feedtoken7"); err != nil || member != 7 {
+		t.Errorf("feed token imported for member %d, %v, want 7", member, err)
+	}
+
+	var version int
+	if err := keysDB.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != KeysImportedVersion {
+		t.Errorf("user_version = %d, want %d", version, KeysImportedVersion)
+	}
+}
+
+func TestOpenKeysDatabaseImportsOnce(t *testing.T) {
+	dir := t.TempDir()
+	legacyPath := filepath.Join(dir, "rockhoppers.db")
+	keysPath := DefaultKeysPath(legacyPath)
+	writeLegacyDatabase(t, legacyPath)
+
+	keysDB, err := OpenKeysDatabase(keysPath, legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys revoked or deleted since mustn't come back from the stale copies
+	// left in the synced file
+	if _, err := keysDB.Exec("DELETE FROM api_keys"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keysDB.Exec("DELETE FROM calendar_feed_tokens"); err != nil {
+		t.Fatal(err)
+	}
+	keysDB.Close()
+
+	keysDB, err = OpenKeysDatabase(keysPath, legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keysDB.Close()
+
+	if _, err := AuthenticateAPIKey(keysDB, "11111111-2222-3333-4444-555555555555"); err != ErrAPIKeyNotFound {
+		t.Errorf("deleted legacy key: error = %v, want %v", err, ErrAPIKeyNotFound)
+	}
+}
+
+func TestOpenKeysDatabaseWithoutLegacyKeys(t *testing.T) {
+	dir := t.TempDir()
+	legacyPath := filepath.Join(dir, "missing.db")
+
+	keysDB, err := OpenKeysDatabase(DefaultKeysPath(legacyPath), legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keysDB.Close()
+
+	if _, err := os.Stat(legacyPath); !os.IsNotExist(err) {
+		t.Error("opening the keys database created the synced database")
+	}
+	empty, err := keysDatabaseEmpty(keysDB)
+	if err != nil || !empty {
+		t.Errorf("keysDatabaseEmpty = %v, %v, want an empty keys database", empty, err)
+	}
+}
@@ -7,27 +7,28 @@ import (
 )
 
 type Meet struct {
-	ID                         int64      `json:"id"`
-	Title                      string     `json:"title"`
-	Description                string     `json:"description"`
-	BookingsOpenDate           *time.Time `json:"bookings_open_date"`
-	StartDate                  *time.Time `json:"start_date"`
-	EndDate                    *time.Time `json:"end_date"`
-	DateNotes                  string     `json:"date_notes"`
-	MeetStewardNotes           string     `json:"meet_steward_notes"`
-	LocationURL                string     `json:"location_url"`
-	SpacesAvailable            *int       `json:"spaces_available"`
-	TotalSpaces                *int       `json:"total_spaces"`
-	CreatedAt                  *time.Time `json:"created_at"`
-	UpdatedAt                  *time.Time `json:"updated_at"`
-	MeetStewardID              *int64     `json:"meet_steward_id"`
-	Bookable                   *int       `json:"bookable"`
-	SelfOrganisingLifts        *int       `json:"self_organising_lifts"`
-	NonLMC                     *int       `json:"nonlmc"`
-	WaitingListSpacesAvailable *int       `json:"waiting_list_spaces_available"`
-	WaitingListTotalSpaces     *int       `json:"waiting_list_total_spaces"`
-	AllowGuests                int        `json:"allow_guests"`
-	WebsiteURL                 string     `json:"website_url"`
+	ID                         int64         `json:"id" db:"id"`
+	Title                      string        `json:"title" db:"title"`
+	Description                string        `json:"description" db:"description"`
+	BookingsOpenDate           *time.Time    `json:"bookings_open_date" db:"bookings_open_date"`
+	StartDate                  *time.Time    `json:"start_date" db:"start_date"`
+	EndDate                    *time.Time    `json:"end_date" db:"end_date"`
+	DateNotes                  string        `json:"date_notes" db:"date_notes"`
+	MeetStewardNotes           string        `json:"meet_steward_notes" db:"meet_steward_notes"`
+	LocationURL                string        `json:"location_url" db:"location_url"`
+	SpacesAvailable            *int          `json:"spaces_available" db:"spaces_available"`
+	TotalSpaces                *int          `json:"total_spaces" db:"total_spaces"`
+	CreatedAt                  *time.Time    `json:"created_at" db:"created_at"`
+	UpdatedAt                  *time.Time    `json:"updated_at" db:"updated_at"`
+	MeetStewardID              *int64        `json:"meet_steward_id" db:"meet_steward_id"`
+	Bookable                   *int          `json:"bookable" db:"bookable"`
+	SelfOrganisingLifts        *int          `json:"self_organising_lifts" db:"self_organising_lifts"`
+	NonLMC                     *int          `json:"nonlmc" db:"nonlmc"`
+	WaitingListSpacesAvailable *int          `json:"waiting_list_spaces_available" db:"waiting_list_spaces_available"`
+	WaitingListTotalSpaces     *int          `json:"waiting_list_total_spaces" db:"waiting_list_total_spaces"`
+	AllowGuests                int           `json:"allow_guests" db:"allow_guests"`
+	WebsiteURL                 string        `json:"website_url" db:"-"`
+	Steward                    *PublicMember `json:"steward,omitempty" db:"-"`
 }
 
 // parseDate attempts to parse a date string using multiple formats
@@ -66,82 +67,109 @@ func nullIntToPtr(n sql.NullInt64) *int {
 	return &val
 }
 
-func ScanMeet(scanner interface {
+func meetColumns(db *sql.DB) (*columnSet, error) {
+	return resolveColumns(db, "meets", Meet{})
+}
+
+// ScanMeet reads a row selected with the column list from meetColumns
+func ScanMeet(cols *columnSet, scanner interface {
 	Scan(dest ...interface{}) error
 }) (*Meet, error) {
 	var m Meet
-	var bookingsOpenDate, startDate, endDate, createdAt, updatedAt sql.NullString
-	var spacesAvailable, totalSpaces, meetStewardID, bookable, selfOrganisingLifts, nonLMC,
-		waitingListSpacesAvailable, waitingListTotalSpaces sql.NullInt64
-
-	err := scanner.Scan(
-		&m.ID,
-		&m.Title,
-		&m.Description,
-		&bookingsOpenDate,
-		&startDate,
-		&endDate,
-		&m.DateNotes,
-		&m.MeetStewardNotes,
-		&m.LocationURL,
-		&spacesAvailable,
-		&totalSpaces,
-		&createdAt,
-		&updatedAt,
-		&meetStewardID,
-		&bookable,
-		&selfOrganisingLifts,
-		&nonLMC,
-		&waitingListSpacesAvailable,
-		&waitingListTotalSpaces,
-		&m.AllowGuests,
-	)
-	if err != nil {
+	if err := cols.scan(scanner, &m); err != nil {
 		return nil, err
 	}
 
-	m.StartDate = parseDate(startDate, "start_date")
-	m.EndDate = parseDate(endDate, "end_date")
-	m.BookingsOpenDate = parseDate(bookingsOpenDate, "bookings_open_date")
-	m.CreatedAt = parseDate(createdAt, "created_at")
-	m.UpdatedAt = parseDate(updatedAt, "updated_at")
-
-	m.SpacesAvailable = nullIntToPtr(spacesAvailable)
-	m.TotalSpaces = nullIntToPtr(totalSpaces)
-	m.Bookable = nullIntToPtr(bookable)
-	m.SelfOrganisingLifts = nullIntToPtr(selfOrganisingLifts)
-	m.NonLMC = nullIntToPtr(nonLMC)
-	m.WaitingListSpacesAvailable = nullIntToPtr(waitingListSpacesAvailable)
-	m.WaitingListTotalSpaces = nullIntToPtr(waitingListTotalSpaces)
 	m.WebsiteURL = fmt.Sprintf("https://www.rockhoppers.org.uk/meets/%d", m.ID)
 
-	if meetStewardID.Valid {
-		m.MeetStewardID = &meetStewardID.Int64
-	}
-
 	return &m, nil
 }
 
-func GetAllMeets(db *sql.DB) ([]Meet, error) {
-	rows, err := db.Query("SELECT * FROM meets")
+func queryMeets(db *sql.DB, cols *columnSet, page *listPage, query string, args ...interface{}) ([]Meet, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var meets []Meet
+	meets := []Meet{}
 	for rows.Next() {
-		meet, err := ScanMeet(rows)
+		meet, err := ScanMeet(cols, page.row(rows))
 		if err != nil {
 			return nil, err
 		}
 		meets = append(meets, *meet)
 	}
 
-	return meets, nil
+	return meets, rows.Err()
+}
+
+func GetAllMeets(db *sql.DB) ([]Meet, error) {
+	cols, err := meetColumns(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return queryMeets(db, cols, nil, fmt.Sprintf("SELECT %s FROM meets", cols.selectList()))
+}
+
+// FindMeets returns every meet matching the query's filters, in order, ignoring
+// pagination
+func FindMeets(db *sql.DB, q ListQuery) ([]Meet, error) {
+	cols, err := meetColumns(db)
+	if err != nil {
+		return nil, err
+	}
+
+	query, args, _, err := buildListSQL(meetsListTable, cols, q, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return queryMeets(db, cols, nil, query, args...)
+}
+
+// ListMeets returns one page of meets matching the query
+func ListMeets(db *sql.DB, q ListQuery) (*Page, error) {
+	cols, err := meetColumns(db)
+	if err != nil {
+		return nil, err
+	}
+
+	query, args, page, err := buildListSQL(meetsListTable, cols, q, true)
+	if err != nil {
+		return nil, err
+	}
+
+	meets, err := queryMeets(db, cols, page, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	next := page.nextCursor()
+	if next != "" {
+		meets = meets[:q.limit()]
+	}
+
+	if q.ExpandSteward {
+		ptrs := make([]*Meet, len(meets))
+		for i := range meets {
+			ptrs[i] = &meets[i]
+		}
+		if err := ExpandMeetStewards(db, ptrs...); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Page{Data: meets, NextCursor: next}, nil
 }
 
 func GetMeetByID(db *sql.DB, id string) (*Meet, error) {
-	row := db.QueryRow("SELECT * FROM meets WHERE id = ?", id)
-	return ScanMeet(row)
+	cols, err := meetColumns(db)
+	if err != nil {
+		return nil, err
+	}
+
+	row := db.QueryRow(fmt.Sprintf("SELECT %s FROM meets WHERE id = ?", cols.selectList()), id)
+	return ScanMeet(cols, row)
 }
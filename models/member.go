@@ -0,0 +1,103 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// MemberPublicColumns is the privacy allowlist for members. The API only ever
+// selects these columns when returning members, whatever else the synced
+// table holds.
+var MemberPublicColumns = []string{"id", "first_name", "last_name", "nickname", "club_email"}
+
+// PublicMember is the view of a member that is safe to share with other members
+type PublicMember struct {
+	ID          int64  `json:"id" db:"id"`
+	FirstName   string `json:"first_name,omitempty" db:"first_name"`
+	LastName    string `json:"last_name,omitempty" db:"last_name"`
+	Nickname    string `json:"nickname,omitempty" db:"nickname"`
+	ClubEmail   string `json:"club_email,omitempty" db:"club_email"`
+	DisplayName string `json:"display_name" db:"-"`
+}
+
+func publicMemberColumns(db *sql.DB) (*columnSet, error) {
+	cols, err := resolveColumns(db, "members", PublicMember{})
+	if err != nil {
+		return nil, err
+	}
+	return cols.restrict(append([]string{"id"}, MemberPublicColumns...)), nil
+}
+
+func scanPublicMember(cols *columnSet, scanner interface {
+	Scan(dest ...interface{}) error
+}) (*PublicMember, error) {
+	var m PublicMember
+	if err := cols.scan(scanner, &m); err != nil {
+		return nil, err
+	}
+
+	m.DisplayName = m.Nickname
+	if m.DisplayName == "" {
+		m.DisplayName = strings.TrimSpace(m.FirstName + " " + m.LastName)
+	}
+
+	return &m, nil
+}
+
+func GetPublicMemberByID(db *sql.DB, id string) (*PublicMember, error) {
+	cols, err := publicMemberColumns(db)
+	if err != nil {
+		return nil, err
+	}
+
+	row := db.QueryRow(fmt.Sprintf("SELECT %s FROM members WHERE id = ?", cols.selectList()), id)
+	return scanPublicMember(cols, row)
+}
+
+// ExpandMeetStewards fills in the Steward of each meet that has one
+func ExpandMeetStewards(db *sql.DB, meets ...*Meet) error {
+	var ids []interface{}
+	var placeholders []string
+	for _, meet := range meets {
+		if meet.MeetStewardID != nil {
+			ids = append(ids, *meet.MeetStewardID)
+			placeholders = append(placeholders, "?")
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	cols, err := publicMemberColumns(db)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM members WHERE id IN (%s)", cols.selectList(), strings.Join(placeholders, ", "))
+	rows, err := db.Query(query, ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	stewards := make(map[int64]*PublicMember)
+	for rows.Next() {
+		m, err := scanPublicMember(cols, rows)
+		if err != nil {
+			return err
+		}
+		stewards[m.ID] = m
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, meet := range meets {
+		if meet.MeetStewardID != nil {
+			meet.Steward = stewards[*meet.MeetStewardID]
+		}
+	}
+
+	return nil
+}
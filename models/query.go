@@ -0,0 +1,439 @@
+package models
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// ErrInvalidQuery wraps every problem with list query parameters so handlers
+// can answer with a 400 rather than a 500
+var ErrInvalidQuery = errors.New("invalid query")
+
+// ListQuery holds the filtering, sorting and pagination options shared by the
+// list endpoints. Nil filters are not applied.
+type ListQuery struct {
+	From      *time.Time
+	To        *time.Time
+	Bookable  *bool
+	HasSpaces *bool
+	StewardID *int64
+	Search    string
+	Sort      string
+	Limit     int
+	Cursor    string
+	// ExpandSteward embeds each meet's steward from the members table
+	ExpandSteward bool
+}
+
+// Page is the response envelope for list endpoints
+type Page struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// listTable describes how a ListQuery maps onto a table's columns
+type listTable struct {
+	name          string
+	dateColumn    string
+	endColumn     string
+	searchColumns []string
+	sortColumns   []string
+	defaultSort   string
+	bookable      string
+	spaces        string
+	steward       string
+}
+
+var meetsListTable = listTable{
+	name:          "meets",
+	dateColumn:    "start_date",
+	endColumn:     "end_date",
+	searchColumns: []string{"title", "description", "date_notes", "meet_steward_notes"},
+	sortColumns:   []string{"id", "title", "start_date", "end_date", "bookings_open_date", "spaces_available", "created_at", "updated_at"},
+	defaultSort:   "start_date",
+	bookable:      "bookable",
+	spaces:        "spaces_available",
+	steward:       "meet_steward_id",
+}
+
+var socialsListTable = listTable{
+	name:          "socials",
+	dateColumn:    "start_date",
+	searchColumns: []string{"title", "description", "speaker", "location"},
+	sortColumns:   []string{"id", "title", "start_date", "created_at", "updated_at"},
+	defaultSort:   "start_date",
+}
+
+func invalidQuery(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidQuery, fmt.Sprintf(format, args...))
+}
+
+func parseQueryBool(values url.Values, name string) (*bool, error) {
+	v := values.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, invalidQuery("%s must be true or false", name)
+	}
+	return &b, nil
+}
+
+func parseQueryDate(values url.Values, name string) (*time.Time, error) {
+	v := values.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, invalidQuery("%s must be a date in YYYY-MM-DD format", name)
+}
+
+// ParseListQuery reads list options from request query parameters
+func ParseListQuery(values url.Values) (ListQuery, error) {
+	var q ListQuery
+	var err error
+
+	if q.From, err = parseQueryDate(values, "from"); err != nil {
+		return q, err
+	}
+	if q.To, err = parseQueryDate(values, "to"); err != nil {
+		return q, err
+	}
+	if q.Bookable, err = parseQueryBool(values, "bookable"); err != nil {
+		return q, err
+	}
+	if q.HasSpaces, err = parseQueryBool(values, "has_spaces"); err != nil {
+		return q, err
+	}
+
+	if v := values.Get("steward_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return q, invalidQuery("steward_id must be an integer")
+		}
+		q.StewardID = &id
+	}
+
+	if q.ExpandSteward, err = ParseExpandSteward(values); err != nil {
+		return q, err
+	}
+
+	q.Search = strings.TrimSpace(values.Get("q"))
+	q.Sort = values.Get("sort")
+	q.Cursor = values.Get("cursor")
+
+	q.Limit = DefaultListLimit
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return q, invalidQuery("limit must be a positive integer")
+		}
+		if limit > MaxListLimit {
+			limit = MaxListLimit
+		}
+		q.Limit = limit
+	}
+
+	return q, nil
+}
+
+func (q ListQuery) limit() int {
+	if q.Limit < 1 {
+		return DefaultListLimit
+	}
+	return q.Limit
+}
+
+// ParseExpandSteward reads the expand parameter, where steward is the only
+// supported expansion
+func ParseExpandSteward(values url.Values) (bool, error) {
+	expand := false
+	for _, e := range strings.Split(values.Get("expand"), ",") {
+		switch e = strings.TrimSpace(e); e {
+		case "":
+		case "steward":
+			expand = true
+		default:
+			return false, invalidQuery("cannot expand %s", e)
+		}
+	}
+	return expand, nil
+}
+
+// listCursor is the sort key of the last row on a page. The next page starts
+// after it, so rows added or removed by a sync don't shift later pages. Sort
+// records the sort the cursor was made for so it can't be reused with another.
+type listCursor struct {
+	Sort  string      `json:"s"`
+	Null  bool        `json:"n,omitempty"`
+	Value interface{} `json:"v,omitempty"`
+	ID    int64       `json:"i"`
+}
+
+func encodeCursor(c listCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor, sort string) (*listCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalidQuery("cursor is not valid")
+	}
+
+	var c listCursor
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&c); err != nil {
+		return nil, invalidQuery("cursor is not valid")
+	}
+	if c.Sort != sort {
+		return nil, invalidQuery("cursor is for a different sort")
+	}
+
+	// Numbers come back as json.Number and have to be bound as the same
+	// storage class they were read as to compare the same way
+	switch v := c.Value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			c.Value = n
+		} else if f, err := v.Float64(); err == nil {
+			c.Value = f
+		} else {
+			return nil, invalidQuery("cursor is not valid")
+		}
+	case string, nil:
+	default:
+		return nil, invalidQuery("cursor is not valid")
+	}
+	if !c.Null && c.Value == nil {
+		return nil, invalidQuery("cursor is not valid")
+	}
+
+	return &c, nil
+}
+
+// listPage collects the sort key of each row fetched for a page, read from
+// the two extra columns buildListSQL selects after the column list
+type listPage struct {
+	sort  string
+	limit int
+	keys  []listCursor
+}
+
+// pageRow scans the page's key columns along with whatever the caller scans
+type pageRow struct {
+	rowScanner
+	page *listPage
+}
+
+func (r pageRow) Scan(dest ...interface{}) error {
+	var value interface{}
+	var id int64
+	if err := r.rowScanner.Scan(append(dest, &value, &id)...); err != nil {
+		return err
+	}
+
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+	r.page.keys = append(r.page.keys, listCursor{Sort: r.page.sort, Null: value == nil, Value: value, ID: id})
+	return nil
+}
+
+// row wraps a result row so its key is recorded when it's scanned. A nil page
+// scans the row unchanged.
+func (p *listPage) row(scanner rowScanner) rowScanner {
+	if p == nil {
+		return scanner
+	}
+	return pageRow{rowScanner: scanner, page: p}
+}
+
+// nextCursor returns the cursor for the page after this one, or an empty
+// string if fewer than limit+1 rows were fetched and there are no more
+func (p *listPage) nextCursor() string {
+	if len(p.keys) <= p.limit {
+		return ""
+	}
+	return encodeCursor(p.keys[p.limit-1])
+}
+
+func escapeLike(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(s)
+}
+
+// buildListSQL turns a ListQuery into parameterised SQL for the table. Column
+// names only ever come from the listTable definition, never from the request,
+// and filters on columns the synced table doesn't have are rejected. When
+// paginating, the sort value and id are selected after the column list, rows
+// after the cursor's key are returned and one more row than the limit is
+// fetched so callers can tell if there is a next page. Rows must be scanned
+// through the returned listPage, which is nil when not paginating.
+func buildListSQL(t listTable, cols *columnSet, q ListQuery, paginate bool) (string, []interface{}, *listPage, error) {
+	var where []string
+	var args []interface{}
+
+	// Treat columns missing from this snapshot as unsupported
+	column := func(name string) string {
+		if name == "" || !cols.has(name) {
+			return ""
+		}
+		return name
+	}
+	t.bookable = column(t.bookable)
+	t.spaces = column(t.spaces)
+	t.steward = column(t.steward)
+	t.endColumn = column(t.endColumn)
+
+	if q.From != nil {
+		// Multi-day events that started before the window but are still
+		// running should be included
+		col := t.dateColumn
+		if t.endColumn != "" {
+			col = fmt.Sprintf("COALESCE(%s, %s)", t.endColumn, t.dateColumn)
+		}
+		where = append(where, fmt.Sprintf("date(%s) >= date(?)", col))
+		args = append(args, q.From.Format("2006-01-02"))
+	}
+
+	if q.To != nil {
+		where = append(where, fmt.Sprintf("date(%s) <= date(?)", t.dateColumn))
+		args = append(args, q.To.Format("2006-01-02"))
+	}
+
+	if q.Bookable != nil {
+		if t.bookable == "" {
+			return "", nil, nil, invalidQuery("bookable is not supported for %s", t.name)
+		}
+		if *q.Bookable {
+			where = append(where, fmt.Sprintf("%s = 1", t.bookable))
+		} else {
+			where = append(where, fmt.Sprintf("COALESCE(%s, 0) = 0", t.bookable))
+		}
+	}
+
+	if q.HasSpaces != nil {
+		if t.spaces == "" {
+			return "", nil, nil, invalidQuery("has_spaces is not supported for %s", t.name)
+		}
+		if *q.HasSpaces {
+			where = append(where, fmt.Sprintf("%s > 0", t.spaces))
+		} else {
+			where = append(where, fmt.Sprintf("COALESCE(%s, 0) <= 0", t.spaces))
+		}
+	}
+
+	if q.StewardID != nil {
+		if t.steward == "" {
+			return "", nil, nil, invalidQuery("steward_id is not supported for %s", t.name)
+		}
+		where = append(where, fmt.Sprintf("%s = ?", t.steward))
+		args = append(args, *q.StewardID)
+	}
+
+	if q.Search != "" {
+		var search []string
+		for _, col := range t.searchColumns {
+			if !cols.has(col) {
+				continue
+			}
+			search = append(search, fmt.Sprintf(`%s LIKE ? ESCAPE '\'`, col))
+			args = append(args, "%"+escapeLike(q.Search)+"%")
+		}
+		if len(search) == 0 {
+			return "", nil, nil, invalidQuery("q is not supported for %s", t.name)
+		}
+		where = append(where, "("+strings.Join(search, " OR ")+")")
+	}
+
+	sortColumn := t.defaultSort
+	if !cols.has(sortColumn) {
+		sortColumn = "id"
+	}
+	direction := "ASC"
+	if q.Sort != "" {
+		sortColumn = strings.TrimPrefix(q.Sort, "-")
+		if strings.HasPrefix(q.Sort, "-") {
+			direction = "DESC"
+		}
+
+		allowed := false
+		for _, col := range t.sortColumns {
+			if col == sortColumn && cols.has(col) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", nil, nil, invalidQuery("cannot sort %s by %s", t.name, sortColumn)
+		}
+	}
+
+	if !paginate {
+		query := fmt.Sprintf("SELECT %s FROM %s", cols.selectList(), t.name)
+		if len(where) > 0 {
+			query += " WHERE " + strings.Join(where, " AND ")
+		}
+		query += fmt.Sprintf(" ORDER BY %s IS NULL, %s %s, id %s", sortColumn, sortColumn, direction, direction)
+		return query, args, nil, nil
+	}
+
+	sort := sortColumn
+	if direction == "DESC" {
+		sort = "-" + sortColumn
+	}
+	cursor, err := decodeCursor(q.Cursor, sort)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	// NULLs sort last whichever the direction, so after a NULL key only
+	// NULLs with a later id remain, and after any other key the NULLs all do
+	if cursor != nil {
+		op := ">"
+		if direction == "DESC" {
+			op = "<"
+		}
+		if cursor.Null {
+			where = append(where, fmt.Sprintf("(%s IS NULL AND id %s ?)", sortColumn, op))
+			args = append(args, cursor.ID)
+		} else {
+			where = append(where, fmt.Sprintf("(%s IS NULL OR (%s, id) %s (?, ?))", sortColumn, sortColumn, op))
+			args = append(args, cursor.Value, cursor.ID)
+		}
+	}
+
+	// The unary plus drops the column's declared type so the driver returns
+	// the stored value rather than converting dates to time.Time
+	query := fmt.Sprintf("SELECT %s, +%s, id FROM %s", cols.selectList(), sortColumn, t.name)
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s IS NULL, %s %s, id %s LIMIT ?", sortColumn, sortColumn, direction, direction)
+	args = append(args, q.limit()+1)
+
+	return query, args, &listPage{sort: sort, limit: q.limit()}, nil
+}
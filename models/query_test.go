@@ -0,0 +1,246 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testColumnSet(table string, model interface{}, columns ...string) *columnSet {
+	present := make(map[string]bool)
+	for _, c := range columns {
+		present[c] = true
+	}
+
+	cs := &columnSet{table: table, present: present}
+	for _, f := range structColumns(reflect.TypeOf(model)) {
+		if present[f.column] {
+			cs.fields = append(cs.fields, f)
+		}
+	}
+	return cs
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestBuildListSQL(t *testing.T) {
+	meets := testColumnSet("meets", Meet{}, "id", "title", "start_date", "end_date", "bookable", "spaces_available", "meet_steward_id")
+	socials := testColumnSet("socials", Social{}, "id", "title", "start_date")
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	steward := int64(7)
+
+	tests := []struct {
+		name     string
+		table    listTable
+		cols     *columnSet
+		q        ListQuery
+		paginate bool
+		where    string
+		order    string
+		args     []interface{}
+	}{
+		{
+			name:  "defaults",
+			table: meetsListTable,
+			cols:  meets,
+			order: " ORDER BY start_date IS NULL, start_date ASC, id ASC",
+		},
+		{
+			name:  "from includes meets still running",
+			table: meetsListTable,
+			cols:  meets,
+			q:     ListQuery{From: &from},
+			where: " WHERE date(COALESCE(end_date, start_date)) >= date(?)",
+			order: " ORDER BY start_date IS NULL, start_date ASC, id ASC",
+			args:  []interface{}{"2024-05-01"},
+		},
+		{
+			name:  "from without an end column",
+			table: socialsListTable,
+			cols:  socials,
+			q:     ListQuery{From: &from},
+			where: " WHERE date(start_date) >= date(?)",
+			order: " ORDER BY start_date IS NULL, start_date ASC, id ASC",
+			args:  []interface{}{"2024-05-01"},
+		},
+		{
+			name:  "has spaces",
+			table: meetsListTable,
+			cols:  meets,
+			q:     ListQuery{HasSpaces: boolPtr(true)},
+			where: " WHERE spaces_available > 0",
+			order: " ORDER BY start_date IS NULL, start_date ASC, id ASC",
+		},
+		{
+			name:  "no spaces includes NULL",
+			table: meetsListTable,
+			cols:  meets,
+			q:     ListQuery{HasSpaces: boolPtr(false)},
+			where: " WHERE COALESCE(spaces_available, 0) <= 0",
+			order: " ORDER BY start_date IS NULL, start_date ASC, id ASC",
+		},
+		{
+			name:  "not bookable includes NULL",
+			table: meetsListTable,
+			cols:  meets,
+			q:     ListQuery{Bookable: boolPtr(false), StewardID: &steward},
+			where: " WHERE COALESCE(bookable, 0) = 0 AND meet_steward_id = ?",
+			order: " ORDER BY start_date IS NULL, start_date ASC, id ASC",
+			args:  []interface{}{int64(7)},
+		},
+		{
+			name:  "search escapes wildcards",
+			table: socialsListTable,
+			cols:  socials,
+			q:     ListQuery{Search: "50%_off"},
+			where: ` WHERE (title LIKE ? ESCAPE '\')`,
+			order: " ORDER BY start_date IS NULL, start_date ASC, id ASC",
+			args:  []interface{}{`%50\%\_off%`},
+		},
+		{
+			name:     "descending first page",
+			table:    meetsListTable,
+			cols:     meets,
+			q:        ListQuery{Sort: "-title", Limit: 10},
+			paginate: true,
+			order:    " ORDER BY title IS NULL, title DESC, id DESC LIMIT ?",
+			args:     []interface{}{11},
+		},
+		{
+			name:     "after a value",
+			table:    meetsListTable,
+			cols:     meets,
+			q:        ListQuery{Limit: 10, Cursor: encodeCursor(listCursor{Sort: "start_date", Value: "2024-05-01", ID: 3})},
+			paginate: true,
+			where:    " WHERE (start_date IS NULL OR (start_date, id) > (?, ?))",
+			order:    " ORDER BY start_date IS NULL, start_date ASC, id ASC LIMIT ?",
+			args:     []interface{}{"2024-05-01", int64(3), 11},
+		},
+		{
+			name:     "after a number descending",
+			table:    meetsListTable,
+			cols:     meets,
+			q:        ListQuery{Sort: "-spaces_available", Limit: 10, Cursor: encodeCursor(listCursor{Sort: "-spaces_available", Value: int64(4), ID: 3})},
+			paginate: true,
+			where:    " WHERE (spaces_available IS NULL OR (spaces_available, id) < (?, ?))",
+			order:    " ORDER BY spaces_available IS NULL, spaces_available DESC, id DESC LIMIT ?",
+			args:     []interface{}{int64(4), int64(3), 11},
+		},
+		{
+			name:     "after a NULL",
+			table:    meetsListTable,
+			cols:     meets,
+			q:        ListQuery{Limit: 10, Cursor: encodeCursor(listCursor{Sort: "start_date", Null: true, ID: 3})},
+			paginate: true,
+			where:    " WHERE (start_date IS NULL AND id > ?)",
+			order:    " ORDER BY start_date IS NULL, start_date ASC, id ASC LIMIT ?",
+			args:     []interface{}{int64(3), 11},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args, page, err := buildListSQL(tt.table, tt.cols, tt.q, tt.paginate)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			selected := "SELECT " + tt.cols.selectList()
+			if tt.paginate {
+				sort := strings.TrimPrefix(tt.q.Sort, "-")
+				if sort == "" {
+					sort = "start_date"
+				}
+				selected += ", +" + sort + ", id"
+			}
+			want := selected + " FROM " + tt.table.name + tt.where + tt.order
+			if query != want {
+				t.Errorf("query\n got %s\nwant %s", query, want)
+			}
+			if !reflect.DeepEqual(args, tt.args) && (len(args) > 0 || len(tt.args) > 0) {
+				t.Errorf("args = %#v, want %#v", args, tt.args)
+			}
+			if (page != nil) != tt.paginate {
+				t.Errorf("page = %v, want one only when paginating", page)
+			}
+		})
+	}
+}
+
+func TestBuildListSQLErrors(t *testing.T) {
+	socials := testColumnSet("socials", Social{}, "id", "title", "start_date")
+	otherSort := encodeCursor(listCursor{Sort: "title", Value: "a", ID: 1})
+
+	tests := []struct {
+		name string
+		q    ListQuery
+	}{
+		{"unsupported filter", ListQuery{HasSpaces: boolPtr(false)}},
+		{"unknown sort column", ListQuery{Sort: "speaker"}},
+		{"garbled cursor", ListQuery{Cursor: "not a cursor"}},
+		{"cursor for another sort", ListQuery{Cursor: otherSort}},
+		{"cursor without a value", ListQuery{Cursor: encodeCursor(listCursor{Sort: "start_date", ID: 1})}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := buildListSQL(socialsListTable, socials, tt.q, true)
+			if !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("err = %v, want ErrInvalidQuery", err)
+			}
+		})
+	}
+}
+
+// TestListSocialsPages walks every page of a table with duplicate and NULL
+// sort values, checking each row comes back exactly once and in order
+func TestListSocialsPages(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE socials (id INTEGER PRIMARY KEY, title TEXT, start_date DATETIME);
+		INSERT INTO socials VALUES
+			(1, 'a', '2024-05-02'), (2, 'b', NULL), (3, 'c', '2024-05-01'),
+			(4, 'd', '2024-05-02'), (5, 'e', NULL), (6, 'f', '2024-05-03'),
+			(7, 'g', '2024-05-02')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for sort, want := range map[string][]int64{
+		"start_date":  {3, 1, 4, 7, 6, 2, 5},
+		"-start_date": {6, 7, 4, 1, 3, 5, 2},
+	} {
+		q := ListQuery{Sort: sort, Limit: 2}
+		var got []int64
+		for pages := 0; ; pages++ {
+			if pages > len(want) {
+				t.Fatalf("sort %s: too many pages", sort)
+			}
+			page, err := ListSocials(db, q)
+			if err != nil {
+				t.Fatalf("sort %s: %v", sort, err)
+			}
+			for _, s := range page.Data.([]Social) {
+				got = append(got, s.ID)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("sort %s: got ids %v, want %v", sort, got, want)
+		}
+	}
+}
@@ -2,81 +2,116 @@ package models
 
 import (
 	"database/sql"
+	"fmt"
 	"time"
 )
 
 type Social struct {
-	ID          int64      `json:"id"`
-	Title       string     `json:"title"`
-	Speaker     string     `json:"speaker"`
-	StartDate   *time.Time `json:"start_date"`
-	StartTime   string     `json:"start_time"`
-	Location    string     `json:"location"`
-	CreatedAt   *time.Time `json:"created_at"`
-	UpdatedAt   *time.Time `json:"updated_at"`
-	Description string     `json:"description"`
+	ID          int64      `json:"id" db:"id"`
+	Title       string     `json:"title" db:"title"`
+	Speaker     string     `json:"speaker" db:"speaker"`
+	StartDate   *time.Time `json:"start_date" db:"start_date"`
+	StartTime   string     `json:"start_time" db:"start_time"`
+	Location    string     `json:"location" db:"location"`
+	CreatedAt   *time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   *time.Time `json:"updated_at" db:"updated_at"`
+	Description string     `json:"description" db:"description"`
 }
 
-func ScanSocial(scanner interface {
+func socialColumns(db *sql.DB) (*columnSet, error) {
+	return resolveColumns(db, "socials", Social{})
+}
+
+// ScanSocial reads a row selected with the column list from socialColumns
+func ScanSocial(cols *columnSet, scanner interface {
 	Scan(dest ...interface{}) error
 }) (*Social, error) {
 	var s Social
-	var startDate, createdAt, updatedAt sql.NullString
-	var speaker, startTime, location sql.NullString
-
-	err := scanner.Scan(
-		&s.ID,
-		&s.Title,
-		&speaker,
-		&startDate,
-		&startTime,
-		&location,
-		&createdAt,
-		&updatedAt,
-		&s.Description,
-	)
-	if err != nil {
+	if err := cols.scan(scanner, &s); err != nil {
 		return nil, err
 	}
-
-	// Handle NULL values
-	if speaker.Valid {
-		s.Speaker = speaker.String
-	}
-	if startTime.Valid {
-		s.StartTime = startTime.String
-	}
-	if location.Valid {
-		s.Location = location.String
-	}
-
-	s.StartDate = parseDate(startDate, "start_date")
-	s.CreatedAt = parseDate(createdAt, "created_at")
-	s.UpdatedAt = parseDate(updatedAt, "updated_at")
-
 	return &s, nil
 }
 
-func GetAllSocials(db *sql.DB) ([]Social, error) {
-	rows, err := db.Query("SELECT * FROM socials")
+func querySocials(db *sql.DB, cols *columnSet, page *listPage, query string, args ...interface{}) ([]Social, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var socials []Social
+	socials := []Social{}
 	for rows.Next() {
-		social, err := ScanSocial(rows)
+		social, err := ScanSocial(cols, page.row(rows))
 		if err != nil {
 			return nil, err
 		}
 		socials = append(socials, *social)
 	}
 
-	return socials, nil
+	return socials, rows.Err()
+}
+
+func GetAllSocials(db *sql.DB) ([]Social, error) {
+	cols, err := socialColumns(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return querySocials(db, cols, nil, fmt.Sprintf("SELECT %s FROM socials", cols.selectList()))
+}
+
+// FindSocials returns every social matching the query's filters, in order, ignoring
+// pagination
+func FindSocials(db *sql.DB, q ListQuery) ([]Social, error) {
+	cols, err := socialColumns(db)
+	if err != nil {
+		return nil, err
+	}
+
+	query, args, _, err := buildListSQL(socialsListTable, cols, q, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return querySocials(db, cols, nil, query, args...)
+}
+
+// ListSocials returns one page of socials matching the query
+func ListSocials(db *sql.DB, q ListQuery) (*Page, error) {
+	cols, err := socialColumns(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.ExpandSteward {
+		return nil, invalidQuery("expand=steward is not supported for socials")
+	}
+
+	query, args, page, err := buildListSQL(socialsListTable, cols, q, true)
+	if err != nil {
+		return nil, err
+	}
+
+	socials, err := querySocials(db, cols, page, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	next := page.nextCursor()
+	if next != "" {
+		socials = socials[:q.limit()]
+	}
+
+	return &Page{Data: socials, NextCursor: next}, nil
 }
 
 func GetSocialByID(db *sql.DB, id string) (*Social, error) {
-	row := db.QueryRow("SELECT * FROM socials WHERE id = ?", id)
-	return ScanSocial(row)
+	cols, err := socialColumns(db)
+	if err != nil {
+		return nil, err
+	}
+
+	row := db.QueryRow(fmt.Sprintf("SELECT %s FROM socials WHERE id = ?", cols.selectList()), id)
+	return ScanSocial(cols, row)
 }
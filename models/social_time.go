@@ -0,0 +1,166 @@
+package models
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // The deployed image has no system zoneinfo
+
+	ics "github.com/arran4/golang-ical"
+)
+
+const londonTZID = "Europe/London"
+
+var londonLocation = mustLoadLocation(londonTZID)
+
+// SocialEventDuration is how long a timed social is assumed to last, as the
+// club only records start times
+var SocialEventDuration = 2 * time.Hour
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// Unmarked hours in this range are read as pm
+const (
+	earliestUnmarkedPM = 5
+	latestUnmarkedPM   = 9
+)
+
+// socialTimePattern matches a time in free text such as "7:30pm",
+// "7.30 p.m.", "7pm", "19:30" or "from 1930 for a 8pm start"
+var socialTimePattern = regexp.MustCompile(`(?i)\b(\d{1,2})(?:[:.]?(\d{2}))?\s*(am|pm|a\.m\.?|p\.m\.?)?(?:\W|$)`)
+
+// parseSocialStartTime extracts an hour and minute from the free-text
+// start_time the club enters for socials, using the first time in the text
+// that can be trusted. Bare numbers without minutes or an am/pm marker, such
+// as prices, are skipped. Times without a marker are taken as written when
+// they're clearly on the 24 hour clock, like "0930", "1030" or "19:30", or
+// are 12. Otherwise only early evening hours, 5 to 9, are read as pm, as
+// socials usually start then; anything else, like "10:00", could be morning
+// or night and is skipped, leaving the social as an all-day event.
+func parseSocialStartTime(s string) (int, int, bool) {
+	s = strings.TrimSpace(s)
+	lower := strings.ToLower(s)
+
+	if strings.Contains(lower, "noon") || strings.Contains(lower, "midday") {
+		return 12, 0, true
+	}
+
+	for _, loc := range socialTimePattern.FindAllStringSubmatchIndex(s, -1) {
+		if hour, minute, ok := socialTimeAt(s, loc); ok {
+			return hour, minute, true
+		}
+	}
+	return 0, 0, false
+}
+
+// socialTimeAt reads the time from one socialTimePattern match
+func socialTimeAt(s string, loc []int) (int, int, bool) {
+	// "£5.50" is a price, not 5:50
+	before := s[:loc[0]]
+	if strings.HasSuffix(before, "£") || strings.HasSuffix(before, "$") {
+		return 0, 0, false
+	}
+
+	hourText := s[loc[2]:loc[3]]
+	hour, _ := strconv.Atoi(hourText)
+
+	minute := 0
+	hasMinutes := loc[4] >= 0
+	if hasMinutes {
+		minute, _ = strconv.Atoi(s[loc[4]:loc[5]])
+	}
+
+	marker := ""
+	if loc[6] >= 0 {
+		marker = strings.ToLower(strings.ReplaceAll(s[loc[6]:loc[7]], ".", ""))
+	}
+
+	if !hasMinutes && marker == "" {
+		return 0, 0, false
+	}
+
+	switch marker {
+	case "am":
+		if hour < 1 || hour > 12 {
+			return 0, 0, false
+		}
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour < 1 || hour > 12 {
+			return 0, 0, false
+		}
+		if hour != 12 {
+			hour += 12
+		}
+	default:
+		// "1030" with no separator is a 24 hour time, like "0930"
+		compact := hasMinutes && len(hourText) == 2 && loc[4] == loc[3]
+		switch {
+		case compact, strings.HasPrefix(hourText, "0"), hour >= 12:
+		case hour >= earliestUnmarkedPM && hour <= latestUnmarkedPM:
+			hour += 12
+		default:
+			return 0, 0, false
+		}
+	}
+
+	if hour > 23 || minute > 59 {
+		return 0, 0, false
+	}
+
+	return hour, minute, true
+}
+
+// socialStartAt combines a social's date and free-text time into a London
+// local time
+func socialStartAt(social Social) (time.Time, bool) {
+	if social.StartDate == nil {
+		return time.Time{}, false
+	}
+
+	hour, minute, ok := parseSocialStartTime(social.StartTime)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	d := *social.StartDate
+	return time.Date(d.Year(), d.Month(), d.Day(), hour, minute, 0, 0, londonLocation), true
+}
+
+// setLondonTime sets a DTSTART or DTEND as a Europe/London local time, which
+// relies on the calendar carrying the matching VTIMEZONE
+func setLondonTime(event *ics.VEvent, property ics.ComponentProperty, t time.Time) {
+	event.SetProperty(property, t.In(londonLocation).Format("20060102T150405"), ics.WithTZID(londonTZID))
+}
+
+// newLondonTimezone describes Europe/London (GMT/BST) for calendar clients
+func newLondonTimezone() *ics.VTimezone {
+	tz := ics.NewTimezone(londonTZID)
+
+	daylight := &ics.Daylight{}
+	daylight.SetProperty(ics.ComponentProperty(ics.PropertyTzoffsetfrom), "+0000")
+	daylight.SetProperty(ics.ComponentProperty(ics.PropertyTzoffsetto), "+0100")
+	daylight.SetProperty(ics.ComponentProperty(ics.PropertyTzname), "BST")
+	daylight.SetProperty(ics.ComponentPropertyDtStart, "19810329T010000")
+	daylight.SetProperty(ics.ComponentPropertyRrule, "FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU")
+
+	standard := tz.AddStandard()
+	standard.SetProperty(ics.ComponentProperty(ics.PropertyTzoffsetfrom), "+0100")
+	standard.SetProperty(ics.ComponentProperty(ics.PropertyTzoffsetto), "+0000")
+	standard.SetProperty(ics.ComponentProperty(ics.PropertyTzname), "GMT")
+	standard.SetProperty(ics.ComponentPropertyDtStart, "19961027T020000")
+	standard.SetProperty(ics.ComponentPropertyRrule, "FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU")
+
+	tz.Components = append(tz.Components, daylight)
+
+	return tz
+}
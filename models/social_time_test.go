@@ -0,0 +1,58 @@
+package models
+
+import "testing"
+
+func TestParseSocialStartTime(t *testing.T) {
+	tests := []struct {
+		in     string
+		hour   int
+		minute int
+		ok     bool
+	}{
+		{"7:30pm", 19, 30, true},
+		{"7.30pm", 19, 30, true},
+		{"7.30 p.m.", 19, 30, true},
+		{"7 PM", 19, 0, true},
+		{"7pm", 19, 0, true},
+		{"19:30", 19, 30, true},
+		{"1930", 19, 30, true},
+		{"7:30", 19, 30, true},
+		{"0930", 9, 30, true},
+		{"1030", 10, 30, true},
+		{"5.30", 17, 30, true},
+		{"9:15", 21, 15, true},
+		{"10:00", 0, 0, false},
+		{"11:30", 0, 0, false},
+		{"3:00", 0, 0, false},
+		{"10:00, or 7:30 for the talk", 19, 30, true},
+		{"10am", 10, 0, true},
+		{"10.30 a.m.", 10, 30, true},
+		{"12pm", 12, 0, true},
+		{"12am", 0, 0, true},
+		{"12:30", 12, 30, true},
+		{"Noon", 12, 0, true},
+		{"midday at the crag", 12, 0, true},
+		{"from 1930 for a 8pm start", 19, 30, true},
+		{"6:45 for 7pm", 18, 45, true},
+		{"£5, 8pm", 20, 0, true},
+		{"£5.50 entry, 7.30pm", 19, 30, true},
+		{"Meet at the pub at 8", 0, 0, false},
+		{"7", 0, 0, false},
+		{"TBC", 0, 0, false},
+		{"", 0, 0, false},
+		{"25:00", 0, 0, false},
+		{"7:75pm", 0, 0, false},
+		{"13pm", 0, 0, false},
+		{"3rd floor", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			hour, minute, ok := parseSocialStartTime(tt.in)
+			if ok != tt.ok || hour != tt.hour || minute != tt.minute {
+				t.Errorf("parseSocialStartTime(%q) = %d, %d, %t, want %d, %d, %t",
+					tt.in, hour, minute, ok, tt.hour, tt.minute, tt.ok)
+			}
+		})
+	}
+}
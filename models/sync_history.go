@@ -0,0 +1,148 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSyncHistory = 10
+	MaxSyncHistory     = 100
+)
+
+// SyncRun is a recorded pass of the sync, as written by the syncer package
+type SyncRun struct {
+	ID         string            `json:"id"`
+	Trigger    string            `json:"trigger"`
+	Tables     []string          `json:"tables,omitempty"`
+	Status     string            `json:"status"`
+	StartedAt  *time.Time        `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Results    []SyncTableResult `json:"results"`
+}
+
+type SyncTableResult struct {
+	Table        string     `json:"table"`
+	Outcome      string     `json:"outcome"`
+	Strategy     string     `json:"strategy,omitempty"`
+	RowsInserted int64      `json:"rows_inserted"`
+	RowsUpdated  int64      `json:"rows_updated"`
+	RowsDeleted  int64      `json:"rows_deleted"`
+	RowsSkipped  int64      `json:"rows_skipped"`
+	Error        string     `json:"error,omitempty"`
+	StartedAt    *time.Time `json:"started_at"`
+	DurationMS   int64      `json:"duration_ms"`
+}
+
+// ParseSyncHistory reads the number of runs to return from the history
+// query parameter
+func ParseSyncHistory(values url.Values) (int, error) {
+	v := values.Get("history")
+	if v == "" {
+		return DefaultSyncHistory, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > MaxSyncHistory {
+		return 0, invalidQuery("history must be between 0 and %d", MaxSyncHistory)
+	}
+	return n, nil
+}
+
+// GetSyncRuns returns the most recent sync runs with their per-table results,
+// newest first. Databases the sync has never recorded a run in have none.
+func GetSyncRuns(db *sql.DB, limit int) ([]SyncRun, error) {
+	runs := []SyncRun{}
+	if limit == 0 {
+		return runs, nil
+	}
+
+	if _, err := tableColumns(db, "sync_runs"); err != nil {
+		return runs, nil
+	}
+
+	rows, err := db.Query(
+		"SELECT id, triggered_by, tables, status, started_at, finished_at, error FROM sync_runs ORDER BY started_at DESC LIMIT ?",
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[string]int)
+	var ids []interface{}
+	for rows.Next() {
+		var r SyncRun
+		var tables, startedAt, finishedAt, runErr sql.NullString
+		if err := rows.Scan(&r.ID, &r.Trigger, &tables, &r.Status, &startedAt, &finishedAt, &runErr); err != nil {
+			return nil, err
+		}
+
+		if tables.String != "" {
+			r.Tables = strings.Split(tables.String, ",")
+		}
+		r.StartedAt = parseDate(startedAt, "started_at")
+		r.FinishedAt = parseDate(finishedAt, "finished_at")
+		r.Error = runErr.String
+		r.Results = []SyncTableResult{}
+
+		byID[r.ID] = len(runs)
+		ids = append(ids, r.ID)
+		runs = append(runs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return runs, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	resultRows, err := db.Query(fmt.Sprintf(`
+		SELECT run_id, table_name, outcome, strategy, rows_inserted, rows_updated, rows_deleted, rows_skipped, error, started_at, duration_ms
+		FROM sync_table_results
+		WHERE run_id IN (%s)
+		ORDER BY started_at
+	`, placeholders), ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer resultRows.Close()
+
+	for resultRows.Next() {
+		var runID string
+		var t SyncTableResult
+		var strategy, resultErr, startedAt sql.NullString
+		err := resultRows.Scan(
+			&runID,
+			&t.Table,
+			&t.Outcome,
+			&strategy,
+			&t.RowsInserted,
+			&t.RowsUpdated,
+			&t.RowsDeleted,
+			&t.RowsSkipped,
+			&resultErr,
+			&startedAt,
+			&t.DurationMS,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		t.Strategy = strategy.String
+		t.Error = resultErr.String
+		t.StartedAt = parseDate(startedAt, "started_at")
+
+		i := byID[runID]
+		runs[i].Results = append(runs[i].Results, t)
+	}
+
+	return runs, resultRows.Err()
+}
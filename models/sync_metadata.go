@@ -2,49 +2,194 @@ package models
 
 import (
 	"database/sql"
+	"fmt"
 	"time"
 )
 
+// SyncStaleAfter is how long after a table's last successful sync its data is
+// flagged as stale
+var SyncStaleAfter = 24 * time.Hour
+
 type SyncMetadata struct {
-	TableName    string    `json:"table_name"`
-	LastSyncTime time.Time `json:"last_sync_time"`
+	TableName string `json:"table_name"`
+	// LastSyncTime is the last successful sync, kept under its original name
+	LastSyncTime    *time.Time `json:"last_sync_time"`
+	LastAttemptTime *time.Time `json:"last_attempt_time,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	Stale           bool       `json:"stale"`
+	RowCount        *int64     `json:"row_count,omitempty"`
+	DeletedCount    *int64     `json:"deleted_count,omitempty"`
+	ChangeStrategy  string     `json:"change_strategy,omitempty"`
+}
+
+// syncMetadataColumns returns the select list for sync_metadata. Databases
+// synced by older versions lack the later columns, which read as NULL, and
+// have only last_sync_time to go on for the last success.
+func syncMetadataColumns(db *sql.DB, columns ...string) (string, error) {
+	present, err := tableColumns(db, "sync_metadata")
+	if err != nil {
+		return "", err
+	}
+
+	list := ""
+	for i, column := range columns {
+		expr := column
+		switch {
+		case column == "last_success_time" && !present[column]:
+			expr = "last_sync_time"
+		case !present[column]:
+			expr = "NULL"
+		}
+		if i > 0 {
+			list += ", "
+		}
+		list += expr
+	}
+	return list, nil
 }
 
 func GetAllSyncMetadata(db *sql.DB) ([]SyncMetadata, error) {
-	rows, err := db.Query("SELECT table_name, last_sync_time FROM sync_metadata")
+	columns, err := syncMetadataColumns(db,
+		"last_success_time", "last_attempt_time", "last_error", "row_count", "deleted_count", "change_strategy")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(fmt.Sprintf("SELECT table_name, %s FROM sync_metadata ORDER BY table_name", columns))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var metadata []SyncMetadata
+	now := time.Now()
+	metadata := []SyncMetadata{}
 	for rows.Next() {
 		var m SyncMetadata
-		var lastSyncStr sql.NullString
+		var lastSuccess, lastAttempt, lastError, strategy sql.NullString
+		var rowCount, deletedCount sql.NullInt64
 
-		err := rows.Scan(&m.TableName, &lastSyncStr)
+		err := rows.Scan(&m.TableName, &lastSuccess, &lastAttempt, &lastError, &rowCount, &deletedCount, &strategy)
 		if err != nil {
 			return nil, err
 		}
 
-		if lastSyncStr.Valid {
-			parsedTime, err := time.Parse("2006-01-02 15:04:05", lastSyncStr.String)
-			if err == nil {
-				m.LastSyncTime = parsedTime
-			} else {
-				parsedTime, err = time.Parse(time.RFC3339, lastSyncStr.String)
-				if err == nil {
-					m.LastSyncTime = parsedTime
-				} else {
-					m.LastSyncTime = time.Now()
-				}
-			}
-		} else {
-			m.LastSyncTime = time.Now()
+		if t, ok := parseSyncTime(lastSuccess); ok {
+			m.LastSyncTime = &t
+		}
+		if t, ok := parseSyncTime(lastAttempt); ok {
+			m.LastAttemptTime = &t
 		}
+		m.LastError = lastError.String
+		m.Stale = isStale(m.LastSyncTime, now)
+		m.RowCount = nullInt64ToPtr(rowCount)
+		m.DeletedCount = nullInt64ToPtr(deletedCount)
+		m.ChangeStrategy = strategy.String
 
 		metadata = append(metadata, m)
 	}
 
-	return metadata, nil
+	return metadata, rows.Err()
+}
+
+func isStale(lastSuccess *time.Time, now time.Time) bool {
+	return lastSuccess == nil || now.Sub(*lastSuccess) > SyncStaleAfter
+}
+
+// parseSyncTime parses the timestamps the sync writes, which have been stored
+// in more than one format over time
+func parseSyncTime(s sql.NullString) (time.Time, bool) {
+	if !s.Valid {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", time.RFC3339, "2006-01-02 15:04:05.999999999-07:00"} {
+		if t, err := time.Parse(layout, s.String); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// GetLastSyncTime returns the most recent time any table was successfully
+// synced, which changes whenever the data being served might have
+func GetLastSyncTime(db *sql.DB) (time.Time, error) {
+	column, err := syncMetadataColumns(db, "last_success_time")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM sync_metadata", column))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer rows.Close()
+
+	var latest time.Time
+	for rows.Next() {
+		var s sql.NullString
+		if err := rows.Scan(&s); err != nil {
+			return time.Time{}, err
+		}
+		if t, ok := parseSyncTime(s); ok && t.After(latest) {
+			latest = t
+		}
+	}
+
+	return latest, rows.Err()
+}
+
+// TableSyncTime is when a table last synced successfully, for noting in
+// calendar events how current they are
+type TableSyncTime struct {
+	LastSuccess time.Time
+	Known       bool
+	Stale       bool
+}
+
+// GetTableSyncTime looks up a table's last successful sync. A table that has
+// never synced is reported as stale rather than as current.
+func GetTableSyncTime(db *sql.DB, table string) TableSyncTime {
+	column, err := syncMetadataColumns(db, "last_success_time")
+	if err != nil {
+		return TableSyncTime{Stale: true}
+	}
+
+	var s sql.NullString
+	err = db.QueryRow(fmt.Sprintf("SELECT %s FROM sync_metadata WHERE table_name = ?", column), table).Scan(&s)
+	if err != nil {
+		return TableSyncTime{Stale: true}
+	}
+
+	t, ok := parseSyncTime(s)
+	if !ok {
+		return TableSyncTime{Stale: true}
+	}
+	return TableSyncTime{LastSuccess: t, Known: true, Stale: isStale(&t, time.Now())}
+}
+
+// stamp is the time to use for DTSTAMP, which must always be set
+func (t TableSyncTime) stamp() time.Time {
+	if t.Known {
+		return t.LastSuccess
+	}
+	return time.Now()
+}
+
+// note is the line appended to event descriptions about how current they are
+func (t TableSyncTime) note() string {
+	switch {
+	case !t.Known:
+		return "Note: These details may be out of date, they have not been synced successfully yet"
+	case t.Stale:
+		return fmt.Sprintf("Note: These details may be out of date, the last successful sync was %s", t.LastSuccess.Format("2 January 2006 15:04:05"))
+	default:
+		return fmt.Sprintf("Note: Meet details and availability correct as of last sync: %s", t.LastSuccess.Format("2 January 2006 15:04:05"))
+	}
+}
+
+func nullInt64ToPtr(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	val := n.Int64
+	return &val
 }
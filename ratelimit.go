@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxRateLimitBuckets bounds each limiter. Past it, buckets that have refilled
+// completely are dropped, since they'd behave the same as a new one, and if
+// none have the least recently used is.
+const maxRateLimitBuckets = 10000
+
+// rateLimit allows requests per period, in bursts of up to requests
+type rateLimit struct {
+	requests int
+	per      time.Duration
+	// off turns limiting off altogether
+	off bool
+}
+
+func (l rateLimit) String() string {
+	if l.off {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", l.requests, l.per)
+}
+
+// parseRateLimit reads a limit written as requests/period, e.g. "120/1m", or
+// "off" for no limit
+func parseRateLimit(value string) (rateLimit, error) {
+	if value == "off" {
+		return rateLimit{off: true}, nil
+	}
+
+	n, per, ok := strings.Cut(value, "/")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("rate limit %q must look like 120/1m", value)
+	}
+	requests, err := strconv.Atoi(strings.TrimSpace(n))
+	if err != nil || requests < 1 {
+		return rateLimit{}, fmt.Errorf("invalid request count in rate limit %q, use off for no limit", value)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(per))
+	if err != nil || d <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid period in rate limit %q", value)
+	}
+
+	return rateLimit{requests: requests, per: d}, nil
+}
+
+// rateLimitFromEnv reads a limit from the environment, falling back to def
+func rateLimitFromEnv(name string, def rateLimit) rateLimit {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	l, err := parseRateLimit(v)
+	if err != nil {
+		log.Printf("Invalid %s, using default %s: %v", name, def, err)
+		return def
+	}
+	return l
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a set of token buckets, one per client
+type rateLimiter struct {
+	limit rateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// newRateLimiter returns nil, which allows everything, for a limit of "off"
+func newRateLimiter(limit rateLimit) *rateLimiter {
+	if limit.off {
+		return nil
+	}
+	return &rateLimiter{limit: limit, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from id's bucket. If there isn't one it says how long
+// until there will be.
+func (l *rateLimiter) allow(id string) (bool, time.Duration) {
+	return l.allowAt(id, time.Now())
+}
+
+func (l *rateLimiter) allowAt(id string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	capacity := float64(l.limit.requests)
+	perSecond := capacity / l.limit.per.Seconds()
+
+	b, ok := l.buckets[id]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.sweep(now, capacity, perSecond)
+		}
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[id] = b
+	}
+
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	return false, wait
+}
+
+func (l *rateLimiter) sweep(now time.Time, capacity, perSecond float64) {
+	var oldest string
+	var oldestLast time.Time
+	freed := false
+	for id, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*perSecond >= capacity {
+			delete(l.buckets, id)
+			freed = true
+		} else if oldest == "" || b.last.Before(oldestLast) {
+			oldest, oldestLast = id, b.last
+		}
+	}
+
+	// Many clients all mid-burst would otherwise grow the map without bound
+	if !freed && oldest != "" {
+		delete(l.buckets, oldest)
+	}
+}
+
+// tooManyRequests rejects a request that went over a rate limit
+func tooManyRequests(c *gin.Context, retryAfter time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+}
+
+// ipRateLimit limits requests from each client IP, other than to the routes
+// in exempt, which limit themselves
+func ipRateLimit(l *rateLimiter, exempt ...string) gin.HandlerFunc {
+	skip := make(map[string]bool)
+	for _, path := range exempt {
+		skip[path] = true
+	}
+
+	return func(c *gin.Context) {
+		if skip[c.FullPath()] {
+			c.Next()
+			return
+		}
+		if ok, retryAfter := l.allow(c.ClientIP()); !ok {
+			tooManyRequests(c, retryAfter)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want rateLimit
+		ok   bool
+	}{
+		{"120/1m", rateLimit{requests: 120, per: time.Minute}, true},
+		{" 10 / 1s ", rateLimit{requests: 10, per: time.Second}, true},
+		{"5000/24h", rateLimit{requests: 5000, per: 24 * time.Hour}, true},
+		{"off", rateLimit{off: true}, true},
+		{"0", rateLimit{}, false},
+		{"0/1m", rateLimit{}, false},
+		{"120", rateLimit{}, false},
+		{"abc/1m", rateLimit{}, false},
+		{"-1/1m", rateLimit{}, false},
+		{"10/soon", rateLimit{}, false},
+		{"10/0s", rateLimit{}, false},
+		{"10/-1m", rateLimit{}, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRateLimit(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseRateLimit(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && got != tt.want {
+			t.Errorf("parseRateLimit(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := newRateLimiter(rateLimit{requests: 2, per: time.Second})
+	start := time.Unix(1700000000, 0)
+
+	steps := []struct {
+		after time.Duration
+		ok    bool
+		wait  time.Duration
+	}{
+		// A new bucket starts full, so the whole burst is allowed
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, 500 * time.Millisecond},
+		// Two a second is a token every 500ms
+		{250 * time.Millisecond, false, 250 * time.Millisecond},
+		{500 * time.Millisecond, true, 0},
+		{500 * time.Millisecond, false, 500 * time.Millisecond},
+		// Refilling stops at the burst size however long the bucket is idle
+		{time.Hour, true, 0},
+		{time.Hour, true, 0},
+		{time.Hour, false, 500 * time.Millisecond},
+	}
+
+	for i, s := range steps {
+		ok, wait := l.allowAt("a", start.Add(s.after))
+		if ok != s.ok || wait != s.wait {
+			t.Errorf("step %d: allow = %v, %s, want %v, %s", i, ok, wait, s.ok, s.wait)
+		}
+	}
+
+	if ok, _ := l.allowAt("b", start); !ok {
+		t.Error("one client's bucket limited another")
+	}
+}
+
+func TestRateLimiterOff(t *testing.T) {
+	l := newRateLimiter(rateLimit{off: true})
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatal("a limit of off refused a request")
+		}
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := newRateLimiter(rateLimit{requests: 1, per: time.Hour})
+	start := time.Unix(1700000000, 0)
+
+	// Fill the limiter with clients that have all used their only token, so
+	// none have refilled when the next new client arrives
+	for i := 0; i < maxRateLimitBuckets; i++ {
+		l.allowAt(fmt.Sprint(i), start.Add(time.Duration(i)*time.Millisecond))
+	}
+	l.allowAt("new", start.Add(time.Minute))
+
+	if len(l.buckets) != maxRateLimitBuckets {
+		t.Errorf("limiter has %d buckets, want %d", len(l.buckets), maxRateLimitBuckets)
+	}
+	if _, ok := l.buckets["0"]; ok {
+		t.Error("least recently used bucket was not evicted")
+	}
+
+	// Once they've refilled they're all dropped
+	l.allowAt("later", start.Add(2*time.Hour))
+	if len(l.buckets) != 1 {
+		t.Errorf("limiter has %d buckets after refilling, want 1", len(l.buckets))
+	}
+}
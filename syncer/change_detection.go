@@ -0,0 +1,149 @@
+package syncer
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Change detection strategies decide which source rows need copying on each run
+const (
+	// StrategyUpdatedAt copies rows whose updated_at is at or after the
+	// high-water mark recorded by the previous sync
+	StrategyUpdatedAt = "updated_at"
+	// StrategyChecksum uses CHECKSUM TABLE and copies the whole table only
+	// when the checksum differs from the previous sync
+	StrategyChecksum = "checksum"
+	// StrategyFull copies every row on every run
+	StrategyFull = "full"
+)
+
+const updatedAtColumn = "updated_at"
+
+// changeState is the change detection bookkeeping stored in sync_metadata
+type changeState struct {
+	Strategy      string
+	HighWaterMark sql.NullString
+	Checksum      sql.NullString
+	// ConfigFingerprint is the sync config the rows were written under
+	ConfigFingerprint string
+}
+
+// parseStrategyOverrides reads per-table strategies from a comma separated
+// list of table=strategy pairs, e.g. "members=checksum,bookings=full"
+func parseStrategyOverrides(value string) map[string]string {
+	overrides := make(map[string]string)
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		table, strategy, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Printf("Warning: ignoring malformed change detection override %q", pair)
+			continue
+		}
+
+		strategy = strings.TrimSpace(strategy)
+		switch strategy {
+		case StrategyUpdatedAt, StrategyChecksum, StrategyFull:
+			overrides[strings.TrimSpace(table)] = strategy
+		default:
+			log.Printf("Warning: unknown change detection strategy %q for table %s", strategy, table)
+		}
+	}
+
+	return overrides
+}
+
+func hasColumn(tableInfo TableInfo, name string) bool {
+	for _, col := range tableInfo.Columns {
+		if strings.EqualFold(col.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseStrategy picks the change detection strategy for a table: one set in
+// strategies wins, otherwise tables with an updated_at column use high-water
+// marks and everything else falls back to checksums
+func chooseStrategy(tableInfo TableInfo, strategies map[string]string) string {
+	if strategy, ok := strategies[tableInfo.Name]; ok {
+		if strategy == StrategyUpdatedAt && !hasColumn(tableInfo, updatedAtColumn) {
+			log.Printf("Warning: table %s has no %s column, using %s change detection", tableInfo.Name, updatedAtColumn, StrategyChecksum)
+			return StrategyChecksum
+		}
+		return strategy
+	}
+
+	if hasColumn(tableInfo, updatedAtColumn) {
+		return StrategyUpdatedAt
+	}
+	return StrategyChecksum
+}
+
+// tableChecksum reads a table's checksum. Tests replace it, since SQLite has
+// no CHECKSUM TABLE.
+var tableChecksum = getTableChecksum
+
+func getTableChecksum(db *sql.DB, tableName string) (sql.NullString, error) {
+	var name string
+	var checksum sql.NullString
+	err := db.QueryRow(fmt.Sprintf("CHECKSUM TABLE %s", tableName)).Scan(&name, &checksum)
+	return checksum, err
+}
+
+func getHighWaterMark(db *sql.DB, tableName string) (sql.NullString, error) {
+	var mark sql.NullString
+	err := db.QueryRow(fmt.Sprintf("SELECT MAX(%s) FROM %s", updatedAtColumn, tableName)).Scan(&mark)
+	return mark, err
+}
+
+// planSync works out which rows of a table need copying. It returns the WHERE
+// clause and arguments for the source query, the state to record once the
+// copy succeeds, and whether the table can be skipped entirely.
+func planSync(mysqlDB *sql.DB, tableInfo TableInfo, strategy string, previous *changeState) (string, []interface{}, changeState, bool) {
+	state := changeState{Strategy: strategy}
+
+	// Switching strategy invalidates whatever the previous run recorded
+	if previous != nil && previous.Strategy != state.Strategy {
+		previous = nil
+	}
+
+	switch state.Strategy {
+	case StrategyUpdatedAt:
+		mark, err := getHighWaterMark(mysqlDB, tableInfo.Name)
+		if err != nil {
+			log.Printf("Error getting high-water mark for %s, doing full sync: %v", tableInfo.Name, err)
+			return "", nil, state, false
+		}
+		state.HighWaterMark = mark
+
+		if previous == nil || !previous.HighWaterMark.Valid {
+			return "", nil, state, false
+		}
+
+		// Rows without an updated_at can't be tracked so they are always copied
+		where := fmt.Sprintf("WHERE %s >= ? OR %s IS NULL", updatedAtColumn, updatedAtColumn)
+		return where, []interface{}{previous.HighWaterMark.String}, state, false
+
+	case StrategyChecksum:
+		checksum, err := tableChecksum(mysqlDB, tableInfo.Name)
+		if err != nil {
+			log.Printf("Error getting checksum for %s, doing full sync: %v", tableInfo.Name, err)
+			return "", nil, state, false
+		}
+		state.Checksum = checksum
+
+		if checksum.Valid && previous != nil && previous.Checksum.Valid && previous.Checksum.String == checksum.String {
+			return "", nil, state, true
+		}
+		return "", nil, state, false
+	}
+
+	return "", nil, state, false
+}
@@ -0,0 +1,170 @@
+package syncer
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func valid(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: true}
+}
+
+func TestChooseStrategy(t *testing.T) {
+	withUpdatedAt := TableInfo{Name: "meets", Columns: []ColumnInfo{{Name: "id"}, {Name: "updated_at"}}}
+	withoutUpdatedAt := TableInfo{Name: "members", Columns: []ColumnInfo{{Name: "id"}}}
+
+	tests := []struct {
+		name       string
+		table      TableInfo
+		strategies map[string]string
+		want       string
+	}{
+		{"updated_at column", withUpdatedAt, nil, StrategyUpdatedAt},
+		{"no updated_at column", withoutUpdatedAt, nil, StrategyChecksum},
+		{"set for the table", withUpdatedAt, map[string]string{"meets": StrategyFull}, StrategyFull},
+		{"set for another table", withUpdatedAt, map[string]string{"members": StrategyFull}, StrategyUpdatedAt},
+		{"updated_at set without the column", withoutUpdatedAt, map[string]string{"members": StrategyUpdatedAt}, StrategyChecksum},
+	}
+
+	for _, tt := range tests {
+		if got := chooseStrategy(tt.table, tt.strategies); got != tt.want {
+			t.Errorf("%s: chooseStrategy = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// openUpdatedAtTable opens an in-memory source table whose rows have the
+// given updated_at values, with ids counting from 1. An empty value is NULL.
+func openUpdatedAtTable(t *testing.T, updatedAt ...string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec("CREATE TABLE meets (id INTEGER PRIMARY KEY, updated_at TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	for i, u := range updatedAt {
+		value := sql.NullString{String: u, Valid: u != ""}
+		if _, err := db.Exec("INSERT INTO meets (id, updated_at) VALUES (?, ?)", i+1, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// selectedIDs runs a planned WHERE clause against the source table
+func selectedIDs(t *testing.T, db *sql.DB, where string, args []interface{}) []int {
+	t.Helper()
+
+	rows, err := db.Query("SELECT id FROM meets "+where, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func TestPlanSyncUpdatedAt(t *testing.T) {
+	source := openUpdatedAtTable(t,
+		"2026-01-01 10:00:00",
+		"2026-02-01 10:00:00",
+		"",
+		"2026-03-01 10:00:00",
+	)
+	meets := TableInfo{Name: "meets", PK: "id"}
+
+	tests := []struct {
+		name     string
+		previous *changeState
+		want     []int
+	}{
+		{"first sync", nil, []int{1, 2, 3, 4}},
+		// Rows at the mark are copied again in case more were written in the
+		// same second, and rows without an updated_at always are
+		{"since the last mark", &changeState{Strategy: StrategyUpdatedAt, HighWaterMark: valid("2026-02-01 10:00:00")}, []int{2, 3, 4}},
+		{"nothing changed since", &changeState{Strategy: StrategyUpdatedAt, HighWaterMark: valid("2026-03-01 10:00:00")}, []int{3, 4}},
+		// A run that skipped rows clears the mark so the next copies the lot
+		{"mark cleared", &changeState{Strategy: StrategyUpdatedAt}, []int{1, 2, 3, 4}},
+		{"switched from checksum", &changeState{Strategy: StrategyChecksum, Checksum: valid("1")}, []int{1, 2, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, args, state, skip := planSync(source, meets, StrategyUpdatedAt, tt.previous)
+			if skip {
+				t.Fatal("planSync skipped an updated_at table")
+			}
+			if got := selectedIDs(t, source, where, args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("copies ids %v, want %v", got, tt.want)
+			}
+			if want := valid("2026-03-01 10:00:00"); state.Strategy != StrategyUpdatedAt || state.HighWaterMark != want {
+				t.Errorf("state = %+v, want the %s mark %q", state, StrategyUpdatedAt, want.String)
+			}
+		})
+	}
+}
+
+func TestPlanSyncChecksum(t *testing.T) {
+	defer func(f func(*sql.DB, string) (sql.NullString, error)) { tableChecksum = f }(tableChecksum)
+
+	meets := TableInfo{Name: "meets", PK: "id"}
+
+	tests := []struct {
+		name      string
+		checksum  sql.NullString
+		err       error
+		previous  *changeState
+		wantSkip  bool
+		wantState sql.NullString
+	}{
+		{"first sync", valid("100"), nil, nil, false, valid("100")},
+		{"unchanged", valid("100"), nil, &changeState{Strategy: StrategyChecksum, Checksum: valid("100")}, true, valid("100")},
+		{"changed", valid("200"), nil, &changeState{Strategy: StrategyChecksum, Checksum: valid("100")}, false, valid("200")},
+		{"previous run failed", valid("100"), nil, &changeState{Strategy: StrategyChecksum}, false, valid("100")},
+		{"switched from updated_at", valid("100"), nil, &changeState{Strategy: StrategyUpdatedAt, Checksum: valid("100")}, false, valid("100")},
+		// MySQL gives a NULL checksum for a table it couldn't read
+		{"no checksum", sql.NullString{}, nil, &changeState{Strategy: StrategyChecksum}, false, sql.NullString{}},
+		{"checksum failed", sql.NullString{}, errors.New("no such table"), &changeState{Strategy: StrategyChecksum, Checksum: valid("100")}, false, sql.NullString{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tableChecksum = func(*sql.DB, string) (sql.NullString, error) {
+				return tt.checksum, tt.err
+			}
+
+			where, args, state, skip := planSync(nil, meets, StrategyChecksum, tt.previous)
+			if skip != tt.wantSkip {
+				t.Errorf("skip = %v, want %v", skip, tt.wantSkip)
+			}
+			// The whole table is copied whenever it isn't skipped
+			if where != "" || args != nil {
+				t.Errorf("planSync = %q %v, want the whole table", where, args)
+			}
+			if state.Strategy != StrategyChecksum || state.Checksum != tt.wantState {
+				t.Errorf("state = %+v, want the %s %+v", state, StrategyChecksum, tt.wantState)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package syncer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Config declares what the sync copies from MySQL and how. Only tables listed
+// under Tables or matching Include are synced, and within listed tables only
+// the listed columns, so the SQLite file shipped to the edge holds just what
+// the API needs.
+type Config struct {
+	// Include and Exclude are table name patterns as understood by path.Match.
+	// Tables matching Include are synced with every column unless they also
+	// match Exclude. Tables listed under Tables are always synced.
+	Include []string `toml:"include"`
+	Exclude []string `toml:"exclude"`
+
+	// BatchSize is how many rows are written per SQLite transaction
+	BatchSize int `toml:"batch_size"`
+
+	// Types overrides the SQLite type used for a MySQL base type, e.g.
+	// DECIMAL = "TEXT" to keep exact values
+	Types map[string]string `toml:"types"`
+
+	Tables map[string]TableConfig `toml:"tables"`
+
+	// path is where the config was loaded from, empty when none was given
+	path string
+}
+
+type TableConfig struct {
+	// Columns to copy. "*" or leaving it out copies every column.
+	Columns []string `toml:"columns"`
+	// Transforms applied to column values before they are written, keyed by
+	// column: "hash", "redact" or "truncate:<n>"
+	Transforms map[string]string `toml:"transforms"`
+
+	// PrimaryKey overrides the key read from MySQL, for tables without one
+	PrimaryKey string `toml:"primary_key"`
+	// Strategy is the change detection strategy: "updated_at", "checksum"
+	// or "full". A strategy for the table in SYNC_CHANGE_DETECTION takes
+	// precedence.
+	Strategy  string `toml:"strategy"`
+	BatchSize int    `toml:"batch_size"`
+	// Types overrides the SQLite type of individual columns. Like the global
+	// overrides they only take effect when the column is created.
+	Types map[string]string `toml:"types"`
+}
+
+// DefaultBatchSize is the number of rows written per SQLite transaction when
+// the config doesn't say
+const DefaultBatchSize = 1000
+
+const (
+	TransformHash     = "hash"
+	TransformRedact   = "redact"
+	TransformTruncate = "truncate"
+)
+
+// LoadConfig reads a TOML sync config. With no path every table and column is
+// copied as before.
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		log.Printf("Warning: no sync config given, copying every table and column")
+		return &Config{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := toml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	cfg.path = path
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+
+	return &cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	// An empty config would drop every synced table, which is never intended
+	if len(cfg.Tables) == 0 && len(cfg.Include) == 0 {
+		return fmt.Errorf("no tables listed or included")
+	}
+
+	for _, pattern := range append(append([]string(nil), cfg.Include...), cfg.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad table pattern %q", pattern)
+		}
+	}
+
+	if cfg.BatchSize < 0 {
+		return fmt.Errorf("batch_size must not be negative")
+	}
+	if err := validateTypes(cfg.Types); err != nil {
+		return err
+	}
+
+	hashed := false
+	for table, tc := range cfg.Tables {
+		for column, transform := range tc.Transforms {
+			name, _, err := parseTransform(transform)
+			if err != nil {
+				return fmt.Errorf("table %s column %s: %v", table, column, err)
+			}
+			// Upserts and deletions match rows on the key, so it has to be
+			// copied as is
+			if tc.PrimaryKey != "" && strings.EqualFold(column, tc.PrimaryKey) {
+				return fmt.Errorf("table %s column %s: the primary key can't be transformed", table, column)
+			}
+			hashed = hashed || name == TransformHash
+		}
+
+		switch tc.Strategy {
+		case "", StrategyUpdatedAt, StrategyChecksum, StrategyFull:
+		default:
+			return fmt.Errorf("table %s: unknown change detection strategy %q", table, tc.Strategy)
+		}
+
+		if tc.BatchSize < 0 {
+			return fmt.Errorf("table %s: batch_size must not be negative", table)
+		}
+		if err := validateTypes(tc.Types); err != nil {
+			return fmt.Errorf("table %s: %v", table, err)
+		}
+	}
+
+	if hashed && os.Getenv("SYNC_HASH_SALT") == "" {
+		log.Printf("Warning: SYNC_HASH_SALT is not set, so hashed columns can be reversed by hashing guesses")
+	}
+
+	return nil
+}
+
+func validateTypes(types map[string]string) error {
+	for name, sqlType := range types {
+		switch strings.ToUpper(sqlType) {
+		case "INTEGER", "TEXT", "REAL", "BLOB", "NUMERIC":
+		default:
+			return fmt.Errorf("type override for %s: unknown SQLite type %q", name, sqlType)
+		}
+	}
+	return nil
+}
+
+// restricted reports whether the config limits what is synced at all
+func (cfg *Config) restricted() bool {
+	return cfg.path != ""
+}
+
+func (cfg *Config) includesTable(name string) bool {
+	if !cfg.restricted() {
+		return true
+	}
+	if _, ok := cfg.Tables[name]; ok {
+		return true
+	}
+	return matchesAny(cfg.Include, name) && !matchesAny(cfg.Exclude, name)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterColumns narrows a table to the configured columns. The primary key is
+// always kept as rows can't be synced without it.
+func (cfg *Config) filterColumns(tableInfo TableInfo) TableInfo {
+	tc, ok := cfg.Tables[tableInfo.Name]
+	if !cfg.restricted() || !ok || len(tc.Columns) == 0 {
+		return tableInfo
+	}
+
+	allowed := make(map[string]bool)
+	for _, c := range tc.Columns {
+		if c == "*" {
+			return tableInfo
+		}
+		allowed[strings.ToLower(c)] = true
+	}
+
+	filtered := tableInfo
+	filtered.Columns = nil
+	for _, col := range tableInfo.Columns {
+		if allowed[strings.ToLower(col.Name)] || col.Name == tableInfo.PK {
+			filtered.Columns = append(filtered.Columns, col)
+		}
+	}
+
+	return filtered
+}
+
+// fingerprint identifies the table's column and transform settings, so a
+// change to them forces a full resync of already copied rows
+func (cfg *Config) fingerprint(table string) string {
+	tc, ok := cfg.Tables[table]
+	if !cfg.restricted() || !ok {
+		return ""
+	}
+
+	columns := append([]string(nil), tc.Columns...)
+	sort.Strings(columns)
+
+	var transforms []string
+	for column, transform := range tc.Transforms {
+		transforms = append(transforms, column+"="+transform)
+	}
+	sort.Strings(transforms)
+
+	sum := sha256.Sum256([]byte(strings.Join(columns, ",") + "|" + strings.Join(transforms, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// primaryKey returns the configured primary key for a table, if any
+func (cfg *Config) primaryKey(table string) string {
+	return cfg.Tables[table].PrimaryKey
+}
+
+func (cfg *Config) batchSize(table string) int {
+	if n := cfg.Tables[table].BatchSize; n > 0 {
+		return n
+	}
+	if cfg.BatchSize > 0 {
+		return cfg.BatchSize
+	}
+	return DefaultBatchSize
+}
+
+// strategies returns the change detection strategy set for each table, from
+// the config and then overrides, e.g. from SYNC_CHANGE_DETECTION, which win.
+// Tables set in neither are left for chooseStrategy to decide.
+func (cfg *Config) strategies(overrides map[string]string) map[string]string {
+	strategies := make(map[string]string)
+	for table, tc := range cfg.Tables {
+		if tc.Strategy != "" {
+			strategies[table] = tc.Strategy
+		}
+	}
+	for table, strategy := range overrides {
+		if configured, ok := strategies[table]; ok && configured != strategy {
+			log.Printf("Table %s: using %s change detection from the environment instead of %s from the config", table, strategy, configured)
+		}
+		strategies[table] = strategy
+	}
+	return strategies
+}
+
+// applyTypes sets the SQLite type of each column, using a per-column override,
+// then an override for the MySQL base type, then mapMySQLTypeToSQLite
+func (cfg *Config) applyTypes(tableInfo TableInfo) TableInfo {
+	baseTypes := make(map[string]string)
+	for mysqlType, sqlType := range cfg.Types {
+		baseTypes[strings.ToUpper(mysqlType)] = strings.ToUpper(sqlType)
+	}
+	columnTypes := cfg.Tables[tableInfo.Name].Types
+
+	columns := make([]ColumnInfo, len(tableInfo.Columns))
+	for i, col := range tableInfo.Columns {
+		baseType := strings.Split(strings.ToUpper(col.Type), "(")[0]
+
+		if sqlType, ok := columnTypes[col.Name]; ok {
+			col.SQLiteType = strings.ToUpper(sqlType)
+		} else if sqlType, ok := baseTypes[baseType]; ok {
+			col.SQLiteType = sqlType
+		} else {
+			col.SQLiteType = mapMySQLTypeToSQLite(col.Type)
+		}
+		columns[i] = col
+	}
+
+	tableInfo.Columns = columns
+	return tableInfo
+}
+
+func parseTransform(transform string) (string, int, error) {
+	name, arg, _ := strings.Cut(transform, ":")
+	switch name {
+	case TransformHash, TransformRedact:
+		return name, 0, nil
+	case TransformTruncate:
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return "", 0, fmt.Errorf("truncate needs a length, e.g. truncate:20")
+		}
+		return name, n, nil
+	default:
+		return "", 0, fmt.Errorf("unknown transform %q", transform)
+	}
+}
+
+// transformsPrimaryKey reports whether a transform is set on the table's key,
+// which validate can only catch when the key is configured rather than read
+// from MySQL
+func (cfg *Config) transformsPrimaryKey(tableInfo TableInfo) bool {
+	for column := range cfg.Tables[tableInfo.Name].Transforms {
+		if strings.EqualFold(column, tableInfo.PK) {
+			return true
+		}
+	}
+	return false
+}
+
+// columnTransformer rewrites a value on its way into SQLite
+type columnTransformer func(interface{}) interface{}
+
+// transformers returns the transform for each column position, nil where the
+// column is copied as is
+func (cfg *Config) transformers(tableInfo TableInfo) []columnTransformer {
+	tc, ok := cfg.Tables[tableInfo.Name]
+	fns := make([]columnTransformer, len(tableInfo.Columns))
+	if !ok || len(tc.Transforms) == 0 {
+		return fns
+	}
+
+	salt := os.Getenv("SYNC_HASH_SALT")
+
+	// Column names match case insensitively, as in the column allowlist
+	byColumn := make(map[string]string)
+	for column, transform := range tc.Transforms {
+		byColumn[strings.ToLower(column)] = transform
+	}
+
+	for i, col := range tableInfo.Columns {
+		transform, ok := byColumn[strings.ToLower(col.Name)]
+		if !ok {
+			continue
+		}
+
+		name, n, _ := parseTransform(transform)
+		nullable := col.Nullable
+
+		switch name {
+		case TransformHash:
+			fns[i] = func(v interface{}) interface{} {
+				if v == nil {
+					return nil
+				}
+				sum := sha256.Sum256([]byte(salt + fmt.Sprint(v)))
+				return hex.EncodeToString(sum[:])
+			}
+		case TransformRedact:
+			fns[i] = func(v interface{}) interface{} {
+				if nullable {
+					return nil
+				}
+				return ""
+			}
+		case TransformTruncate:
+			fns[i] = func(v interface{}) interface{} {
+				s, ok := v.(string)
+				if !ok {
+					return v
+				}
+				if r := []rune(s); len(r) > n {
+					return string(r[:n])
+				}
+				return s
+			}
+		}
+	}
+
+	return fns
+}
@@ -0,0 +1,167 @@
+package syncer
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Table outcomes
+const (
+	TableSynced    = "synced"
+	TableUnchanged = "unchanged"
+	TableFailed    = "failed"
+)
+
+// historyTables hold the sync's own run history. They are written to the live
+// database once a run has finished, so failed runs that never swap in a
+// snapshot are still recorded.
+var historyTables = []string{"sync_runs", "sync_table_results"}
+
+// maxStoredRuns is how many runs are kept in sync_runs
+const maxStoredRuns = 500
+
+// TableResult is the outcome of syncing one table in a run. RowsSkipped counts
+// source rows that couldn't be written, e.g. because of a conversion error.
+type TableResult struct {
+	Table        string    `json:"table"`
+	Outcome      string    `json:"outcome"`
+	Strategy     string    `json:"strategy,omitempty"`
+	RowsInserted int       `json:"rows_inserted"`
+	RowsUpdated  int       `json:"rows_updated"`
+	RowsDeleted  int       `json:"rows_deleted"`
+	RowsSkipped  int       `json:"rows_skipped"`
+	Error        string    `json:"error,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	DurationMS   int64     `json:"duration_ms"`
+}
+
+// fail logs a problem syncing the table and records it as the result's error
+func (r *TableResult) fail(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("Table %s: %s", r.Table, msg)
+	r.Outcome = TableFailed
+	if r.Error == "" {
+		r.Error = msg
+	}
+}
+
+func ensureHistoryTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS sync_runs (
+			id TEXT PRIMARY KEY,
+			triggered_by TEXT NOT NULL,
+			tables TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			started_at TIMESTAMP NOT NULL,
+			finished_at TIMESTAMP,
+			error TEXT
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create sync_runs table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS sync_table_results (
+			run_id TEXT NOT NULL,
+			table_name TEXT NOT NULL,
+			outcome TEXT NOT NULL,
+			strategy TEXT,
+			rows_inserted INTEGER NOT NULL DEFAULT 0,
+			rows_updated INTEGER NOT NULL DEFAULT 0,
+			rows_deleted INTEGER NOT NULL DEFAULT 0,
+			rows_skipped INTEGER NOT NULL DEFAULT 0,
+			error TEXT,
+			started_at TIMESTAMP NOT NULL,
+			duration_ms INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (run_id, table_name)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create sync_table_results table: %v", err)
+	}
+
+	return nil
+}
+
+// recordRun writes a finished run and its table results to the live database,
+// pruning the oldest runs beyond maxStoredRuns
+func recordRun(dbPath string, run Run) error {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := ensureHistoryTables(db); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var finishedAt sql.NullString
+	if run.FinishedAt != nil {
+		finishedAt = sql.NullString{String: run.FinishedAt.Format(time.RFC3339), Valid: true}
+	}
+
+	_, err = tx.Exec(
+		"INSERT OR REPLACE INTO sync_runs (id, triggered_by, tables, status, started_at, finished_at, error) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		run.ID,
+		run.Trigger,
+		strings.Join(run.Tables, ","),
+		run.Status,
+		run.StartedAt.Format(time.RFC3339),
+		finishedAt,
+		sql.NullString{String: run.Error, Valid: run.Error != ""},
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, result := range run.Results {
+		_, err = tx.Exec(`
+			INSERT OR REPLACE INTO sync_table_results
+				(run_id, table_name, outcome, strategy, rows_inserted, rows_updated, rows_deleted, rows_skipped, error, started_at, duration_ms)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+			run.ID,
+			result.Table,
+			result.Outcome,
+			result.Strategy,
+			result.RowsInserted,
+			result.RowsUpdated,
+			result.RowsDeleted,
+			result.RowsSkipped,
+			sql.NullString{String: result.Error, Valid: result.Error != ""},
+			result.StartedAt.Format(time.RFC3339),
+			result.DurationMS,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		"DELETE FROM sync_runs WHERE id NOT IN (SELECT id FROM sync_runs ORDER BY started_at DESC LIMIT ?)",
+		maxStoredRuns,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM sync_table_results WHERE run_id NOT IN (SELECT id FROM sync_runs)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
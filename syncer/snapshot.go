@@ -0,0 +1,195 @@
+package syncer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/rossmackay/rockhoppers-db/models"
+)
+
+// apiOwnedTables were written by the API server before it moved them to its
+// own keys database. Until the keys database has imported them their latest
+// contents are copied from the live database just before the swap, so an API
+// that hasn't imported them yet doesn't lose them. After that they're dropped.
+var apiOwnedTables = models.KeyTables
+
+// keysImported reports whether the keys database at path has imported the API
+// owned tables. A missing or unreadable keys database hasn't.
+func keysImported(path string) bool {
+	if path == "" {
+		return false
+	}
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		log.Printf("Warning: failed to read keys database version, keeping API owned tables: %v", err)
+		return false
+	}
+	return version >= models.KeysImportedVersion
+}
+
+// prepareStagingDatabase copies the live database into a staging file next to
+// it, which the sync then writes into. The API keeps reading the live file
+// untouched until swapInSnapshot replaces it.
+func prepareStagingDatabase(livePath string) (string, error) {
+	stagingPath := livePath + ".staging"
+
+	for _, p := range []string{stagingPath, stagingPath + "-journal"} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("error removing stale staging file %s: %v", p, err)
+		}
+	}
+
+	if _, err := os.Stat(livePath); os.IsNotExist(err) {
+		log.Printf("No existing database at %s, building a new one", livePath)
+		return stagingPath, nil
+	}
+
+	liveDB, err := sql.Open("sqlite3", livePath)
+	if err != nil {
+		return "", err
+	}
+	defer liveDB.Close()
+
+	if _, err := liveDB.Exec("VACUUM INTO ?", stagingPath); err != nil {
+		return "", fmt.Errorf("error copying live database to staging: %v", err)
+	}
+
+	return stagingPath, nil
+}
+
+// copyAPIOwnedTables replaces the staging copy of each API owned table, and of
+// the sync's run history, with the current live contents, picking up writes
+// made while the sync ran. Once the keys database at keysPath has imported the
+// API owned tables they are dropped from staging instead.
+func copyAPIOwnedTables(ctx context.Context, stagingDB *sql.DB, livePath, keysPath string) error {
+	tables := historyTables
+	if keysImported(keysPath) {
+		for _, table := range apiOwnedTables {
+			if _, err := stagingDB.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", table)); err != nil {
+				return fmt.Errorf("error dropping %s: %v", table, err)
+			}
+		}
+	} else {
+		tables = append(append([]string(nil), apiOwnedTables...), historyTables...)
+	}
+
+	if _, err := os.Stat(livePath); os.IsNotExist(err) {
+		return nil
+	}
+
+	// ATTACH is per connection, so everything has to run on the same one
+	conn, err := stagingDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS live", livePath); err != nil {
+		return fmt.Errorf("error attaching live database: %v", err)
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE live")
+
+	for _, table := range tables {
+		var count int
+		err := conn.QueryRowContext(ctx, "SELECT count(*) FROM live.sqlite_master WHERE type='table' AND name=?", table).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			continue
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS main.%s", table)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		var createSQL string
+		err = tx.QueryRow("SELECT sql FROM live.sqlite_master WHERE type='table' AND name=?", table).Scan(&createSQL)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if _, err := tx.Exec(createSQL); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("INSERT INTO main.%s SELECT * FROM live.%s", table, table)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// swapInSnapshot bumps the snapshot generation, closes the staging database
+// and atomically renames it over the live file. Readers holding the old file
+// open keep a consistent view until they reopen.
+func swapInSnapshot(stagingDB *sql.DB, stagingPath, livePath, keysPath string) error {
+	if err := copyAPIOwnedTables(context.Background(), stagingDB, livePath, keysPath); err != nil {
+		return fmt.Errorf("error copying API owned tables: %v", err)
+	}
+
+	var generation int64
+	if err := stagingDB.QueryRow("PRAGMA user_version").Scan(&generation); err != nil {
+		return err
+	}
+	generation++
+	if _, err := stagingDB.Exec(fmt.Sprintf("PRAGMA user_version = %d", generation)); err != nil {
+		return err
+	}
+
+	if err := stagingDB.Close(); err != nil {
+		return err
+	}
+
+	if err := syncFile(stagingPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(stagingPath, livePath); err != nil {
+		return fmt.Errorf("error renaming staging database into place: %v", err)
+	}
+
+	if err := syncFile(filepath.Dir(livePath)); err != nil {
+		log.Printf("Warning: failed to sync directory after swap: %v", err)
+	}
+
+	log.Printf("Swapped in snapshot generation %d at %s", generation, livePath)
+	return nil
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
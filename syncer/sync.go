@@ -0,0 +1,833 @@
+package syncer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type TableInfo struct {
+	Name    string
+	Columns []ColumnInfo
+	PK      string
+}
+
+type ColumnInfo struct {
+	Name     string
+	Type     string
+	Nullable bool
+	// SQLiteType is the type the column is created with in SQLite
+	SQLiteType string
+}
+
+// sync copies the run's tables from MySQL into a staging copy of the SQLite
+// database and swaps it in. Problems with individual tables are logged and
+// skipped; an error is returned only when no snapshot could be produced.
+func (s *Syncer) sync(ctx context.Context, run *Run) error {
+	mysqlDB, err := sql.Open("mysql", s.mysqlDSN)
+	if err != nil {
+		return fmt.Errorf("failed to connect to MySQL: %v", err)
+	}
+	defer mysqlDB.Close()
+
+	if err := mysqlDB.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to ping MySQL: %v", err)
+	}
+
+	// Build the new snapshot in a staging copy so the API never reads a
+	// half-synced mix of tables
+	stagingFile, err := prepareStagingDatabase(s.dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to prepare staging database: %v", err)
+	}
+
+	sqliteDB, err := sql.Open("sqlite3", stagingFile)
+	if err != nil {
+		return fmt.Errorf("failed to open SQLite database: %v", err)
+	}
+	defer sqliteDB.Close()
+
+	if err := initSQLiteMetadata(sqliteDB); err != nil {
+		return err
+	}
+
+	cfg := s.cfg
+	tables, err := getTableList(mysqlDB, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to get table list: %v", err)
+	}
+
+	tables, err = s.selectTables(run, tables)
+	if err != nil {
+		return err
+	}
+
+	for _, tableName := range tables {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("sync interrupted before table %s: %v", tableName, err)
+		}
+
+		log.Printf("Processing table: %s", tableName)
+		s.updateRun(run, func(r *Run) { r.CurrentTable = tableName })
+
+		result := s.syncTable(ctx, mysqlDB, sqliteDB, tableName)
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("sync interrupted during table %s: %v", tableName, err)
+		}
+
+		s.updateRun(run, func(r *Run) {
+			r.Results = append(r.Results, result)
+			r.TablesDone++
+		})
+	}
+	s.updateRun(run, func(r *Run) { r.CurrentTable = "" })
+
+	if cfg.restricted() {
+		if err := dropDisallowedTables(sqliteDB, cfg); err != nil {
+			log.Printf("Error dropping tables no longer in the sync config: %v", err)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("sync interrupted before swap: %v", err)
+	}
+
+	if err := swapInSnapshot(sqliteDB, stagingFile, s.dbPath, s.KeysDBPath); err != nil {
+		return fmt.Errorf("failed to swap in new snapshot: %v", err)
+	}
+
+	log.Println("Sync completed successfully")
+	return nil
+}
+
+// syncTable brings one table's SQLite copy up to date and reports what it did
+func (s *Syncer) syncTable(ctx context.Context, mysqlDB, sqliteDB *sql.DB, tableName string) TableResult {
+	cfg := s.cfg
+	result := TableResult{Table: tableName, StartedAt: time.Now().UTC()}
+	defer func() {
+		result.DurationMS = time.Since(result.StartedAt).Milliseconds()
+	}()
+
+	tableInfo, err := getTableInfo(mysqlDB, tableName, cfg.primaryKey(tableName))
+	if err != nil {
+		result.fail("error getting structure: %v", err)
+		return result
+	}
+
+	tableInfo = cfg.applyTypes(cfg.filterColumns(tableInfo))
+	if cfg.transformsPrimaryKey(tableInfo) {
+		result.fail("primary key %s can't be transformed", tableInfo.PK)
+		return result
+	}
+
+	schemaChanged, err := ensureTableInSQLite(sqliteDB, tableInfo)
+	if err != nil {
+		result.fail("%v", err)
+		return result
+	}
+	if cfg.restricted() && dropDisallowedColumns(sqliteDB, tableInfo) {
+		schemaChanged = true
+	}
+
+	lastSync, err := getLastSyncInfo(sqliteDB, tableName)
+	if err != nil {
+		log.Printf("Error getting last sync info for %s: %v", tableName, err)
+	}
+
+	// New tables and columns need every row copied, not just recent
+	// changes, as do rows written under different transforms
+	fingerprint := cfg.fingerprint(tableName)
+	if schemaChanged || (lastSync != nil && lastSync.ConfigFingerprint != fingerprint) {
+		lastSync = nil
+	}
+
+	strategy := chooseStrategy(tableInfo, s.strategies)
+	state, err := syncTableData(ctx, mysqlDB, sqliteDB, tableInfo, strategy, lastSync, cfg.transformers(tableInfo), cfg.batchSize(tableName), &result)
+	if ctx.Err() != nil {
+		return result
+	}
+	if err != nil {
+		result.fail("%v", err)
+	} else {
+		state.ConfigFingerprint = fingerprint
+
+		deletedRows, err := deleteRemovedRows(mysqlDB, sqliteDB, tableInfo)
+		if err != nil {
+			result.fail("error propagating deletions: %v", err)
+		}
+		result.RowsDeleted = deletedRows
+		if deletedRows > 0 && result.Outcome == TableUnchanged {
+			result.Outcome = TableSynced
+		}
+	}
+
+	if err := updateSyncMetadata(sqliteDB, result, state); err != nil {
+		result.fail("error updating sync metadata: %v", err)
+	}
+	return result
+}
+
+func initSQLiteMetadata(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS sync_metadata (
+			table_name TEXT PRIMARY KEY,
+			last_sync_time TIMESTAMP,
+			row_count INTEGER
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create metadata table: %v", err)
+	}
+
+	migrations := []struct{ column, definition string }{
+		{"deleted_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"change_strategy", "TEXT"},
+		{"high_water_mark", "TEXT"},
+		{"source_checksum", "TEXT"},
+		{"config_fingerprint", "TEXT"},
+		{"last_attempt_time", "TIMESTAMP"},
+		{"last_success_time", "TIMESTAMP"},
+		{"last_error", "TEXT"},
+	}
+	for _, m := range migrations {
+		if err := addColumnIfMissing(db, "sync_metadata", m.column, m.definition); err != nil {
+			return fmt.Errorf("failed to migrate metadata table: %v", err)
+		}
+	}
+
+	// Before the split last_sync_time was the only record of a sync
+	_, err = db.Exec("UPDATE sync_metadata SET last_success_time = last_sync_time WHERE last_success_time IS NULL")
+	if err != nil {
+		return fmt.Errorf("failed to migrate metadata table: %v", err)
+	}
+
+	return nil
+}
+
+func addColumnIfMissing(db *sql.DB, tableName, columnName, columnDef string) error {
+	var count int
+	err := db.QueryRow(
+		fmt.Sprintf("SELECT COUNT(*) FROM pragma_table_info('%s') WHERE name = ?", tableName),
+		columnName,
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tableName, columnName, columnDef))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Added column %s to table %s", columnName, tableName)
+	return nil
+}
+
+// getTableList returns the MySQL tables the config allows to be synced
+func getTableList(db *sql.DB, cfg *Config) ([]string, error) {
+	rows, err := db.Query("SHOW TABLES")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var tableName string
+		if err := rows.Scan(&tableName); err != nil {
+			return nil, err
+		}
+		if !cfg.includesTable(tableName) {
+			continue
+		}
+		tables = append(tables, tableName)
+	}
+
+	found := make(map[string]bool)
+	for _, t := range tables {
+		found[t] = true
+	}
+	for name := range cfg.Tables {
+		if !found[name] {
+			log.Printf("Warning: table %s is in the sync config but not in MySQL", name)
+		}
+	}
+
+	return tables, nil
+}
+
+// getTableInfo reads a table's columns and primary key from MySQL. pkOverride,
+// when set, is used as the key instead of the one MySQL reports.
+func getTableInfo(db *sql.DB, tableName string, pkOverride string) (TableInfo, error) {
+	rows, err := db.Query(fmt.Sprintf("DESCRIBE %s", tableName))
+	if err != nil {
+		return TableInfo{}, err
+	}
+	defer rows.Close()
+
+	tableInfo := TableInfo{Name: tableName}
+	for rows.Next() {
+		var field, fieldType, null, key, extra, defaultValue sql.NullString
+		if err := rows.Scan(&field, &fieldType, &null, &key, &defaultValue, &extra); err != nil {
+			return TableInfo{}, err
+		}
+
+		col := ColumnInfo{
+			Name:       field.String,
+			Type:       fieldType.String,
+			Nullable:   null.String == "YES",
+			SQLiteType: mapMySQLTypeToSQLite(fieldType.String),
+		}
+		tableInfo.Columns = append(tableInfo.Columns, col)
+
+		if key.String == "PRI" {
+			tableInfo.PK = field.String
+		}
+	}
+
+	if pkOverride != "" {
+		if !hasColumn(tableInfo, pkOverride) {
+			return TableInfo{}, fmt.Errorf("configured primary key %s is not a column of %s", pkOverride, tableName)
+		}
+		tableInfo.PK = pkOverride
+	} else if tableInfo.PK == "" && len(tableInfo.Columns) > 0 {
+		tableInfo.PK = tableInfo.Columns[0].Name
+		log.Printf("Warning: No primary key found for table %s, using first column %s as key", tableName, tableInfo.PK)
+	}
+
+	return tableInfo, nil
+}
+
+// ensureTableInSQLite creates or extends the SQLite copy of a table and reports
+// whether its schema changed
+func ensureTableInSQLite(db *sql.DB, tableInfo TableInfo) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name=?", tableInfo.Name).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error checking if table exists in SQLite: %v", err)
+	}
+
+	if count == 0 {
+		return createTableInSQLite(db, tableInfo)
+	}
+	return updateTableInSQLite(db, tableInfo)
+}
+
+func createTableInSQLite(db *sql.DB, tableInfo TableInfo) (bool, error) {
+	var columnDefs []string
+	for _, col := range tableInfo.Columns {
+		nullConstraint := ""
+		if !col.Nullable {
+			nullConstraint = " NOT NULL"
+		}
+
+		pkConstraint := ""
+		if col.Name == tableInfo.PK {
+			pkConstraint = " PRIMARY KEY"
+		}
+
+		columnDefs = append(columnDefs, fmt.Sprintf("%s %s%s%s", col.Name, col.SQLiteType, nullConstraint, pkConstraint))
+	}
+
+	createSQL := fmt.Sprintf("CREATE TABLE %s (%s)", tableInfo.Name, strings.Join(columnDefs, ", "))
+
+	_, err := db.Exec(createSQL)
+	if err != nil {
+		log.Printf("SQL: %s", createSQL)
+		return false, fmt.Errorf("error creating table in SQLite: %v", err)
+	}
+
+	log.Printf("Created new table %s in SQLite", tableInfo.Name)
+	return true, nil
+}
+
+func updateTableInSQLite(db *sql.DB, tableInfo TableInfo) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", tableInfo.Name))
+	if err != nil {
+		return false, fmt.Errorf("error getting SQLite table schema: %v", err)
+	}
+	defer rows.Close()
+
+	existingColumns := make(map[string]ColumnInfo)
+
+	for rows.Next() {
+		var cid int
+		var name, typeName string
+		var notNull, pk int
+		var dfltValue interface{}
+
+		if err := rows.Scan(&cid, &name, &typeName, &notNull, &dfltValue, &pk); err != nil {
+			log.Printf("Error scanning column info: %v", err)
+			continue
+		}
+
+		existingColumns[name] = ColumnInfo{
+			Name:     name,
+			Type:     typeName,
+			Nullable: notNull == 0,
+		}
+	}
+
+	changed := false
+	for _, col := range tableInfo.Columns {
+		if _, exists := existingColumns[col.Name]; !exists {
+			nullConstraint := ""
+			if !col.Nullable {
+				nullConstraint = " NOT NULL"
+			}
+
+			alterSQL := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s%s",
+				tableInfo.Name, col.Name, col.SQLiteType, nullConstraint)
+
+			_, err := db.Exec(alterSQL)
+			if err != nil {
+				return changed, fmt.Errorf("error adding column %s: %v", col.Name, err)
+			}
+			log.Printf("Added column %s to table %s", col.Name, tableInfo.Name)
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// dropDisallowedColumns removes columns from the SQLite copy of a table that
+// the sync config no longer allows, so data copied before a column was taken
+// off the allowlist doesn't linger. It reports whether any were dropped.
+func dropDisallowedColumns(db *sql.DB, tableInfo TableInfo) bool {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", tableInfo.Name)
+	if err != nil {
+		log.Printf("Error getting SQLite table schema for %s: %v", tableInfo.Name, err)
+		return false
+	}
+
+	var existing []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			log.Printf("Error scanning column info: %v", err)
+			continue
+		}
+		existing = append(existing, name)
+	}
+	rows.Close()
+
+	changed := false
+	for _, name := range existing {
+		if hasColumn(tableInfo, name) {
+			continue
+		}
+
+		_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", tableInfo.Name, name))
+		if err != nil {
+			log.Printf("Error dropping column %s from table %s: %v", name, tableInfo.Name, err)
+		} else {
+			log.Printf("Dropped column %s from table %s, it is not in the sync config", name, tableInfo.Name)
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// dropDisallowedTables removes previously synced tables that the sync config
+// no longer lists. Only tables recorded in sync_metadata are considered, so
+// tables the sync or the API manage themselves are never touched.
+func dropDisallowedTables(db *sql.DB, cfg *Config) error {
+	rows, err := db.Query("SELECT table_name FROM sync_metadata")
+	if err != nil {
+		return err
+	}
+
+	var synced []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		synced = append(synced, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range synced {
+		if cfg.includesTable(name) || isManagedTable(name) {
+			continue
+		}
+
+		if _, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", name)); err != nil {
+			return fmt.Errorf("error dropping table %s: %v", name, err)
+		}
+		if _, err := db.Exec("DELETE FROM sync_metadata WHERE table_name = ?", name); err != nil {
+			return err
+		}
+		log.Printf("Dropped table %s, it is not in the sync config", name)
+	}
+
+	return nil
+}
+
+// isManagedTable reports whether a table is created locally rather than
+// copied from MySQL
+func isManagedTable(name string) bool {
+	if name == "sync_metadata" {
+		return true
+	}
+	for _, t := range append(append([]string(nil), apiOwnedTables...), historyTables...) {
+		if name == t {
+			return true
+		}
+	}
+	return false
+}
+
+func mapMySQLTypeToSQLite(mysqlType string) string {
+	mysqlType = strings.ToUpper(mysqlType)
+
+	baseType := strings.Split(mysqlType, "(")[0]
+
+	switch baseType {
+	case "INT", "TINYINT", "SMALLINT", "MEDIUMINT", "BIGINT":
+		return "INTEGER"
+	case "CHAR", "VARCHAR", "TEXT", "TINYTEXT", "MEDIUMTEXT", "LONGTEXT", "ENUM", "SET":
+		return "TEXT"
+	case "FLOAT", "DOUBLE", "DECIMAL":
+		return "REAL"
+	case "DATE", "DATETIME", "TIMESTAMP", "TIME", "YEAR":
+		return "TEXT"
+	case "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB":
+		return "BLOB"
+	default:
+		return "TEXT"
+	}
+}
+
+func getLastSyncInfo(db *sql.DB, tableName string) (*changeState, error) {
+	var state changeState
+	var strategy, fingerprint sql.NullString
+	err := db.QueryRow(
+		"SELECT change_strategy, high_water_mark, source_checksum, config_fingerprint FROM sync_metadata WHERE table_name = ?",
+		tableName,
+	).Scan(&strategy, &state.HighWaterMark, &state.Checksum, &fingerprint)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No prior sync
+		}
+		return nil, err
+	}
+
+	state.Strategy = strategy.String
+	state.ConfigFingerprint = fingerprint.String
+	return &state, nil
+}
+
+// syncTableData copies new and changed rows from MySQL into SQLite, counting
+// them in result using the given change detection strategy. It returns the
+// change detection state to record once the
+// table has been synced. transforms holds the configured transform for each
+// column, nil where there is none, and rows are committed batchSize at a time.
+func syncTableData(ctx context.Context, mysqlDB *sql.DB, sqliteDB *sql.DB, tableInfo TableInfo, strategy string, lastSync *changeState, transforms []columnTransformer, batchSize int, result *TableResult) (*changeState, error) {
+	var columnNames []string
+	pkIndex := 0
+	for i, col := range tableInfo.Columns {
+		columnNames = append(columnNames, col.Name)
+		if col.Name == tableInfo.PK {
+			pkIndex = i
+		}
+	}
+	columnsStr := strings.Join(columnNames, ", ")
+
+	where, args, state, skip := planSync(mysqlDB, tableInfo, strategy, lastSync)
+	result.Strategy = state.Strategy
+	if skip {
+		log.Printf("Table %s: No changes detected (%s), skipping sync", tableInfo.Name, state.Strategy)
+		result.Outcome = TableUnchanged
+		return &state, nil
+	}
+
+	// Keys already copied tell inserts apart from updates
+	existingKeys, err := getPrimaryKeySet(sqliteDB, tableInfo)
+	if err != nil {
+		return nil, fmt.Errorf("error reading existing keys: %v", err)
+	}
+
+	query := strings.TrimSpace(fmt.Sprintf("SELECT %s FROM %s %s", columnsStr, tableInfo.Name, where))
+	rows, err := mysqlDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying data: %v", err)
+	}
+	defer rows.Close()
+
+	placeholders := make([]string, len(columnNames))
+	for i := range placeholders {
+		placeholders[i] = "?"
+	}
+
+	insertSQL := fmt.Sprintf(
+		"INSERT OR REPLACE INTO %s (%s) VALUES (%s)",
+		tableInfo.Name,
+		columnsStr,
+		strings.Join(placeholders, ", "),
+	)
+	stmt, err := sqliteDB.Prepare(insertSQL)
+	if err != nil {
+		return nil, fmt.Errorf("error preparing insert statement: %v", err)
+	}
+	defer stmt.Close()
+
+	// Transactions are tied to ctx so cancelling rolls back the open batch
+	tx, err := sqliteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error starting SQLite transaction: %v", err)
+	}
+	txStmt := tx.Stmt(stmt)
+
+	updatedRows := 0
+
+	for rows.Next() {
+		values := make([]interface{}, len(columnNames))
+		valuePtrs := make([]interface{}, len(columnNames))
+
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+
+		if err := rows.Scan(valuePtrs...); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			result.RowsSkipped++
+			continue
+		}
+
+		rowValues := make([]interface{}, len(columnNames))
+		for i, v := range values {
+			if byteValue, ok := v.([]byte); ok {
+				rowValues[i] = string(byteValue)
+			} else {
+				rowValues[i] = v
+			}
+			if transforms[i] != nil {
+				rowValues[i] = transforms[i](rowValues[i])
+			}
+		}
+
+		_, err = txStmt.Exec(rowValues...)
+		if err != nil {
+			log.Printf("Error upserting row: %v", err)
+			result.RowsSkipped++
+			continue
+		}
+
+		if _, ok := existingKeys[primaryKeyString(rowValues[pkIndex])]; ok {
+			result.RowsUpdated++
+		} else {
+			result.RowsInserted++
+		}
+
+		updatedRows++
+
+		if updatedRows%batchSize == 0 {
+			if err := tx.Commit(); err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("error committing transaction: %v", err)
+			}
+			log.Printf("Table %s: Upserted %d rows so far", tableInfo.Name, updatedRows)
+
+			tx, err = sqliteDB.BeginTx(ctx, nil)
+			if err != nil {
+				return nil, fmt.Errorf("error starting SQLite transaction: %v", err)
+			}
+			txStmt = tx.Stmt(stmt)
+		}
+	}
+
+	// A read that stopped early, e.g. on shutdown, mustn't be recorded as a
+	// complete sync
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("error reading data: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	// Skipped rows are older than the new high-water mark and may match the
+	// new checksum, so recording either would mean they're never copied.
+	// Leaving them unset makes the next run copy the whole table again.
+	if result.RowsSkipped > 0 {
+		log.Printf("Table %s: %d rows skipped, next sync will copy every row", tableInfo.Name, result.RowsSkipped)
+		state.HighWaterMark = sql.NullString{}
+		state.Checksum = sql.NullString{}
+	}
+
+	log.Printf("Table %s: Synced %d rows (%s)", tableInfo.Name, updatedRows, state.Strategy)
+	result.Outcome = TableSynced
+	return &state, nil
+}
+
+// primaryKeyString normalises a primary key value so keys read from MySQL
+// ([]byte for most types) compare equal to the same key read from SQLite
+func primaryKeyString(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+func getPrimaryKeySet(db *sql.DB, tableInfo TableInfo) (map[string]interface{}, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s", tableInfo.PK, tableInfo.Name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[string]interface{})
+	for rows.Next() {
+		var pk interface{}
+		if err := rows.Scan(&pk); err != nil {
+			return nil, err
+		}
+		keys[primaryKeyString(pk)] = pk
+	}
+
+	return keys, rows.Err()
+}
+
+// deleteRemovedRows removes rows from SQLite whose primary key no longer
+// exists in MySQL, e.g. meets or socials that were deleted at source
+func deleteRemovedRows(mysqlDB *sql.DB, sqliteDB *sql.DB, tableInfo TableInfo) (int, error) {
+	sourceKeys, err := getPrimaryKeySet(mysqlDB, tableInfo)
+	if err != nil {
+		return 0, fmt.Errorf("error reading primary keys from MySQL: %v", err)
+	}
+
+	localKeys, err := getPrimaryKeySet(sqliteDB, tableInfo)
+	if err != nil {
+		return 0, fmt.Errorf("error reading primary keys from SQLite: %v", err)
+	}
+
+	var removed []interface{}
+	for key, pk := range localKeys {
+		if _, ok := sourceKeys[key]; !ok {
+			removed = append(removed, pk)
+		}
+	}
+
+	if len(removed) == 0 {
+		return 0, nil
+	}
+
+	// An empty source almost certainly means a bad read rather than every row
+	// having been deleted, so don't wipe the local copy
+	if len(sourceKeys) == 0 {
+		log.Printf("Warning: MySQL returned no rows for %s, not deleting %d local rows", tableInfo.Name, len(removed))
+		return 0, nil
+	}
+
+	tx, err := sqliteDB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting SQLite transaction: %v", err)
+	}
+
+	stmt, err := tx.Prepare(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", tableInfo.Name, tableInfo.PK))
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("error preparing delete statement: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, pk := range removed {
+		if _, err := stmt.Exec(pk); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("error deleting row %v: %v", pk, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("error committing deletes: %v", err)
+	}
+
+	log.Printf("Table %s: Deleted %d rows removed from MySQL", tableInfo.Name, len(removed))
+	return len(removed), nil
+}
+
+// updateSyncMetadata records the outcome of a table sync. Every attempt is
+// recorded, but the success time, counts and change detection state only move
+// on when the table synced, so the next run picks up where the last successful
+// one left off and the API never reports stale data as fresh.
+func updateSyncMetadata(db *sql.DB, result TableResult, state *changeState) error {
+	now := time.Now().Format(time.RFC3339)
+
+	if result.Outcome == TableFailed {
+		_, err := db.Exec(`
+			INSERT INTO sync_metadata (table_name, last_attempt_time, last_error)
+			VALUES (?, ?, ?)
+			ON CONFLICT (table_name) DO UPDATE SET
+				last_attempt_time = excluded.last_attempt_time,
+				last_error = excluded.last_error
+		`,
+			result.Table,
+			now,
+			result.Error,
+		)
+		return err
+	}
+
+	var rowCount int
+	err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", result.Table)).Scan(&rowCount)
+	if err != nil {
+		return fmt.Errorf("error getting row count: %v", err)
+	}
+
+	// last_sync_time is kept for readers that predate the split and, like
+	// last_success_time, only advances on success
+	_, err = db.Exec(`
+		INSERT INTO sync_metadata (table_name, last_sync_time, last_attempt_time, last_success_time, last_error, row_count, deleted_count)
+		VALUES (?, ?, ?, ?, NULL, ?, ?)
+		ON CONFLICT (table_name) DO UPDATE SET
+			last_sync_time = excluded.last_sync_time,
+			last_attempt_time = excluded.last_attempt_time,
+			last_success_time = excluded.last_success_time,
+			last_error = NULL,
+			row_count = excluded.row_count,
+			deleted_count = excluded.deleted_count
+	`,
+		result.Table,
+		now,
+		now,
+		now,
+		rowCount,
+		result.RowsDeleted,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		"UPDATE sync_metadata SET change_strategy = ?, high_water_mark = ?, source_checksum = ?, config_fingerprint = ? WHERE table_name = ?",
+		state.Strategy,
+		state.HighWaterMark,
+		state.Checksum,
+		state.ConfigFingerprint,
+		result.Table,
+	)
+	if err != nil {
+		return fmt.Errorf("error updating change detection state: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package syncer
+
+import (
+	"database/sql"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// openTestTable opens an in-memory database holding a meets table with the
+// given ids. SQLite stands in for MySQL too, since only the primary keys are
+// read from it.
+func openTestTable(t *testing.T, ids ...int) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec("CREATE TABLE meets (id INTEGER PRIMARY KEY, title TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if _, err := db.Exec("INSERT INTO meets (id, title) VALUES (?, 'meet')", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func tableIDs(t *testing.T, db *sql.DB) []int {
+	t.Helper()
+
+	rows, err := db.Query("SELECT id FROM meets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func TestDeleteRemovedRows(t *testing.T) {
+	meets := TableInfo{Name: "meets", PK: "id"}
+
+	tests := []struct {
+		name        string
+		source      []int
+		local       []int
+		wantDeleted int
+		wantLocal   []int
+	}{
+		{"rows deleted at source", []int{1, 3}, []int{1, 2, 3, 4}, 2, []int{1, 3}},
+		{"nothing deleted", []int{1, 2, 3}, []int{1, 2}, 0, []int{1, 2}},
+		{"empty local copy", []int{1, 2}, nil, 0, []int{}},
+		// An empty read from MySQL is more likely a fault than every row
+		// having gone, so the local copy is kept
+		{"empty source", nil, []int{1, 2}, 0, []int{1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := openTestTable(t, tt.source...)
+			local := openTestTable(t, tt.local...)
+
+			deleted, err := deleteRemovedRows(source, local, meets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != tt.wantDeleted {
+				t.Errorf("deleted %d rows, want %d", deleted, tt.wantDeleted)
+			}
+			if got := tableIDs(t, local); !reflect.DeepEqual(got, tt.wantLocal) {
+				t.Errorf("local ids = %v, want %v", got, tt.wantLocal)
+			}
+		})
+	}
+}
+
+func TestDeleteRemovedRowsSourceError(t *testing.T) {
+	source, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	local := openTestTable(t, 1, 2)
+
+	// A source that can't be read mustn't be taken as one with no rows
+	if _, err := deleteRemovedRows(source, local, TableInfo{Name: "meets", PK: "id"}); err == nil {
+		t.Error("deleteRemovedRows succeeded without a source table")
+	}
+	if got := tableIDs(t, local); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("local ids = %v, want [1 2]", got)
+	}
+}
@@ -0,0 +1,314 @@
+// Package syncer copies tables from the club's MySQL database into the SQLite
+// file the API serves. It is used by the mysql-sqlite-sync command and can be
+// embedded in the API server.
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Run statuses
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	// RunPartial is a run that swapped in a snapshot but failed some tables
+	RunPartial     = "partial"
+	RunInterrupted = "interrupted"
+)
+
+// Run triggers
+const (
+	TriggerManual   = "manual"
+	TriggerSchedule = "schedule"
+	TriggerAdmin    = "admin"
+)
+
+var (
+	ErrSyncInProgress = errors.New("a sync is already running")
+	ErrUnknownTable   = errors.New("table is not synced")
+	ErrRunNotFound    = errors.New("sync run not found")
+)
+
+// maxRuns is how many finished runs are kept for GetRun
+const maxRuns = 50
+
+// Run is one pass of the sync, over every configured table or just the ones
+// asked for
+type Run struct {
+	ID           string     `json:"id"`
+	Trigger      string     `json:"trigger"`
+	Tables       []string   `json:"tables,omitempty"`
+	Status       string     `json:"status"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	CurrentTable string     `json:"current_table,omitempty"`
+	TablesDone   int        `json:"tables_done"`
+	TablesTotal  int        `json:"tables_total"`
+	Error        string     `json:"error,omitempty"`
+
+	Results []TableResult `json:"results,omitempty"`
+}
+
+// Status summarises the syncer's recent activity
+type Status struct {
+	Current             *Run       `json:"current,omitempty"`
+	LastRun             *Run       `json:"last_run,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	NextRun             *time.Time `json:"next_run,omitempty"`
+}
+
+// Syncer runs syncs one at a time and keeps track of recent runs
+type Syncer struct {
+	cfg      *Config
+	mysqlDSN string
+	dbPath   string
+	// strategies are the change detection strategies set per table
+	strategies map[string]string
+
+	// AfterSwap, if set, is called once a new snapshot is in place, e.g. to
+	// make the API reopen the database straight away
+	AfterSwap func()
+
+	// KeysDBPath, if set, is the API's keys database. Once that has imported
+	// the API owned tables they are dropped from new snapshots rather than
+	// carried over.
+	KeysDBPath string
+
+	mu                  sync.Mutex
+	current             *Run
+	runs                []*Run
+	lastSuccess         *time.Time
+	consecutiveFailures int
+	nextRun             *time.Time
+}
+
+// New returns a Syncer copying from mysqlDSN into the SQLite file at dbPath.
+// Change detection strategies come from the config, overridden per table by
+// SYNC_CHANGE_DETECTION, e.g. "members=checksum,bookings=full".
+func New(cfg *Config, mysqlDSN, dbPath string) *Syncer {
+	return &Syncer{
+		cfg:        cfg,
+		mysqlDSN:   mysqlDSN,
+		dbPath:     dbPath,
+		strategies: cfg.strategies(parseStrategyOverrides(os.Getenv("SYNC_CHANGE_DETECTION"))),
+	}
+}
+
+// RunNow syncs the given tables, or every configured table if none are given,
+// and waits for the run to finish. The error says why if it didn't succeed,
+// including when it only partly did.
+func (s *Syncer) RunNow(ctx context.Context, trigger string, tables ...string) (Run, error) {
+	run, err := s.begin(trigger, tables)
+	if err != nil {
+		return Run{}, err
+	}
+
+	s.execute(ctx, run)
+
+	finished, err := s.GetRun(run.ID)
+	if err != nil {
+		return finished, err
+	}
+	if finished.Status != RunSucceeded {
+		return finished, errors.New(finished.Error)
+	}
+	return finished, nil
+}
+
+// Start begins a sync in the background and returns straight away. ctx
+// controls the run itself, so it shouldn't be a request context.
+func (s *Syncer) Start(ctx context.Context, trigger string, tables ...string) (Run, error) {
+	run, err := s.begin(trigger, tables)
+	if err != nil {
+		return Run{}, err
+	}
+
+	snapshot, _ := s.GetRun(run.ID)
+	go s.execute(ctx, run)
+	return snapshot, nil
+}
+
+func (s *Syncer) begin(trigger string, tables []string) (*Run, error) {
+	for _, table := range tables {
+		if !s.cfg.includesTable(table) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownTable, table)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil {
+		return nil, ErrSyncInProgress
+	}
+
+	run := &Run{
+		ID:        uuid.New().String(),
+		Trigger:   trigger,
+		Tables:    tables,
+		Status:    RunRunning,
+		StartedAt: time.Now().UTC(),
+	}
+	s.current = run
+	s.nextRun = nil
+
+	s.runs = append(s.runs, run)
+	if len(s.runs) > maxRuns {
+		s.runs = s.runs[len(s.runs)-maxRuns:]
+	}
+
+	return run, nil
+}
+
+func (s *Syncer) execute(ctx context.Context, run *Run) {
+	log.Printf("Starting %s sync run %s", run.Trigger, run.ID)
+
+	err := s.sync(ctx, run)
+	swapped := err == nil
+	var partial error
+	if err == nil {
+		// A snapshot went in, but if no table made it into it MySQL is as
+		// good as unreachable and the run should back off like one that
+		// couldn't connect. Some tables failing is reported without backing
+		// off, so the rest keep syncing on schedule.
+		s.mu.Lock()
+		failed := failedTables(run.Results)
+		if len(failed) > 0 && len(failed) == len(run.Results) {
+			err = fmt.Errorf("every table failed: %s", strings.Join(failed, ", "))
+		} else if len(failed) > 0 {
+			partial = fmt.Errorf("%d of %d tables failed: %s", len(failed), len(run.Results), strings.Join(failed, ", "))
+		}
+		s.mu.Unlock()
+	}
+
+	finished := time.Now().UTC()
+	s.mu.Lock()
+	run.FinishedAt = &finished
+	run.CurrentTable = ""
+	switch {
+	case ctx.Err() != nil:
+		// Shutting down, not a failure worth backing off for
+		run.Status = RunInterrupted
+		run.Error = ctx.Err().Error()
+	case err != nil:
+		run.Status = RunFailed
+		run.Error = err.Error()
+		s.consecutiveFailures++
+	case partial != nil:
+		run.Status = RunPartial
+		run.Error = partial.Error()
+		s.consecutiveFailures = 0
+	default:
+		run.Status = RunSucceeded
+		s.lastSuccess = &finished
+		s.consecutiveFailures = 0
+	}
+	s.current = nil
+	finishedRun := *run
+	finishedRun.Results = append([]TableResult(nil), run.Results...)
+	s.mu.Unlock()
+
+	if err := recordRun(s.dbPath, finishedRun); err != nil {
+		log.Printf("Error recording sync run %s: %v", run.ID, err)
+	}
+
+	if err != nil {
+		log.Printf("Sync run %s failed: %v", run.ID, err)
+	} else if partial != nil {
+		log.Printf("Sync run %s partly failed: %v", run.ID, partial)
+	}
+
+	if swapped && s.AfterSwap != nil {
+		s.AfterSwap()
+	}
+}
+
+// failedTables lists the tables whose results record a failure
+func failedTables(results []TableResult) []string {
+	var failed []string
+	for _, r := range results {
+		if r.Outcome == TableFailed {
+			failed = append(failed, r.Table)
+		}
+	}
+	return failed
+}
+
+// selectTables narrows the tables found in MySQL to the ones the run asked for
+func (s *Syncer) selectTables(run *Run, available []string) ([]string, error) {
+	tables := available
+	if len(run.Tables) > 0 {
+		found := make(map[string]bool)
+		for _, t := range available {
+			found[t] = true
+		}
+		for _, t := range run.Tables {
+			if !found[t] {
+				return nil, fmt.Errorf("%w: %s", ErrUnknownTable, t)
+			}
+		}
+		tables = run.Tables
+	}
+
+	s.updateRun(run, func(r *Run) { r.TablesTotal = len(tables) })
+	return tables, nil
+}
+
+func (s *Syncer) updateRun(run *Run, fn func(*Run)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(run)
+}
+
+// GetRun returns a copy of a recent run
+func (s *Syncer) GetRun(id string) (Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, run := range s.runs {
+		if run.ID == id {
+			found := *run
+			found.Results = append([]TableResult(nil), run.Results...)
+			return found, nil
+		}
+	}
+	return Run{}, ErrRunNotFound
+}
+
+// Status returns a snapshot of the syncer's current state
+func (s *Syncer) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := Status{
+		LastSuccess:         s.lastSuccess,
+		ConsecutiveFailures: s.consecutiveFailures,
+		NextRun:             s.nextRun,
+	}
+	if s.current != nil {
+		current := *s.current
+		current.Results = nil
+		status.Current = &current
+	}
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		if s.runs[i].FinishedAt != nil {
+			last := *s.runs[i]
+			last.Results = nil
+			status.LastRun = &last
+			break
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,104 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// WatchOptions control how often Watch syncs
+type WatchOptions struct {
+	// Interval is the time between syncs
+	Interval time.Duration
+	// Jitter is the most random extra delay added to each interval, so
+	// several instances don't all hit MySQL at once
+	Jitter time.Duration
+	// MaxBackoff caps the wait between retries after failed syncs
+	MaxBackoff time.Duration
+}
+
+// WatchOptionsFromEnv reads SYNC_INTERVAL, SYNC_JITTER and SYNC_MAX_BACKOFF
+func WatchOptionsFromEnv() WatchOptions {
+	return WatchOptions{
+		Interval:   envDuration("SYNC_INTERVAL", 15*time.Minute, false),
+		Jitter:     envDuration("SYNC_JITTER", time.Minute, true),
+		MaxBackoff: envDuration("SYNC_MAX_BACKOFF", time.Hour, false),
+	}
+}
+
+// envDuration reads a duration, falling back for values that don't parse or
+// are negative. Zero is only accepted when allowZero is set, since a zero
+// interval would sync back to back and a zero backoff never grows.
+func envDuration(name string, fallback time.Duration, allowZero bool) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 || (d == 0 && !allowZero) {
+		log.Printf("Warning: invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// Watch syncs straight away and then on every interval until ctx is
+// cancelled. A sync in progress when ctx is cancelled is abandoned rather than
+// swapped in.
+func (s *Syncer) Watch(ctx context.Context, opts WatchOptions) {
+	log.Printf("Watching for changes every %s (jitter up to %s)", opts.Interval, opts.Jitter)
+
+	for {
+		_, err := s.RunNow(ctx, TriggerSchedule)
+		if errors.Is(err, ErrSyncInProgress) {
+			log.Printf("Skipping scheduled sync, another run is in progress")
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		delay := s.nextDelay(opts)
+		next := time.Now().Add(delay).UTC()
+		s.mu.Lock()
+		s.nextRun = &next
+		s.mu.Unlock()
+		log.Printf("Next sync at %s", next.Format(time.RFC3339))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	log.Println("Stopped watching for changes")
+}
+
+// nextDelay is the interval plus jitter, doubled for each consecutive failure
+// up to MaxBackoff so an unreachable MySQL isn't hammered
+func (s *Syncer) nextDelay(opts WatchOptions) time.Duration {
+	s.mu.Lock()
+	failures := s.consecutiveFailures
+	s.mu.Unlock()
+
+	delay := opts.Interval
+	for i := 0; i < failures && delay < opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if failures > 0 && delay > opts.MaxBackoff && opts.MaxBackoff > opts.Interval {
+		delay = opts.MaxBackoff
+	}
+
+	if opts.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(opts.Jitter)))
+	}
+	return delay
+}